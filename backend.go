@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/ollama/ollama/api"
+)
+
+// all model traffic goes through an llmBackend, the ollama API client satisfies it as-is and
+// other providers translate the ollama request and response types to and from their own APIs
+type llmBackend interface {
+	Generate(ctx context.Context, req *api.GenerateRequest, fn api.GenerateResponseFunc) error
+	Chat(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error
+	Create(ctx context.Context, req *api.CreateRequest, fn api.CreateProgressFunc) error
+	Delete(ctx context.Context, req *api.DeleteRequest) error
+	Show(ctx context.Context, req *api.ShowRequest) (*api.ShowResponse, error)
+}
+
+// Backend names accepted by the -backend flag
+const (
+	backendOllama = "ollama"
+	backendOpenAI = "openai"
+)
+
+// create the backend selected on the command line
+func getBackend(backendName string, openAIBaseURL string) (llmBackend, error) {
+	switch backendName {
+	case backendOllama:
+		return getClientFromEnvironment(), nil
+	case backendOpenAI:
+		return newOpenAIBackend(openAIBaseURL, getOpenAIKeyFromEnvironment()), nil
+	default:
+		return nil, fmt.Errorf("unrecognized backend '%s' - expected one of '%s', '%s'", backendName, backendOllama, backendOpenAI)
+	}
+}
+
+// the parts of a Modelfile we care about for backends that have no model creation concept
+type modelfileDefinition struct {
+	From       string
+	Parameters map[string]string
+	System     string
+	Messages   []api.Message
+}
+
+// parse the FROM, PARAMETER, SYSTEM and MESSAGE instructions out of a Modelfile
+// values may be wrapped in triple quotes to span multiple lines, anything else is ignored
+func parseModelfile(content string) (*modelfileDefinition, error) {
+	definition := &modelfileDefinition{
+		Parameters: map[string]string{},
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		instruction, value, _ := strings.Cut(line, " ")
+		value = strings.TrimSpace(value)
+
+		// gather the rest of a triple quoted value
+		if strings.HasPrefix(value, `"""`) {
+			value = strings.TrimPrefix(value, `"""`)
+			for !strings.HasSuffix(value, `"""`) {
+				if !scanner.Scan() {
+					return nil, fmt.Errorf("unterminated triple quoted value for %s", instruction)
+				}
+				value = value + "\n" + scanner.Text()
+			}
+			value = strings.TrimSuffix(value, `"""`)
+		}
+
+		switch strings.ToUpper(instruction) {
+		case "FROM":
+			definition.From = value
+		case "PARAMETER":
+			name, parameterValue, _ := strings.Cut(value, " ")
+			definition.Parameters[name] = strings.TrimSpace(parameterValue)
+		case "SYSTEM":
+			definition.System = value
+		case "MESSAGE":
+			role, messageContent, _ := strings.Cut(value, " ")
+			definition.Messages = append(definition.Messages, api.Message{Role: role, Content: strings.TrimSpace(messageContent)})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if definition.From == "" {
+		return nil, fmt.Errorf("the Modelfile has no FROM instruction")
+	}
+	return definition, nil
+}
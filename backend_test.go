@@ -0,0 +1,57 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ollama/ollama/api"
+)
+
+func TestParseModelfile(t *testing.T) {
+	modelfiles := []struct {
+		name       string
+		modelfile  string
+		definition *modelfileDefinition
+		err        bool
+	}{
+		{
+			name:      "every instruction",
+			modelfile: "FROM phi3\n# a comment\nPARAMETER temperature 0\nparameter top_k 20\nSYSTEM Answer true or false.\nMESSAGE user Do you sell records?\nMESSAGE assistant true\nTEMPLATE ignored\n",
+			definition: &modelfileDefinition{
+				From:       "phi3",
+				Parameters: map[string]string{"temperature": "0", "top_k": "20"},
+				System:     "Answer true or false.",
+				Messages:   []api.Message{{Role: "user", Content: "Do you sell records?"}, {Role: "assistant", Content: "true"}},
+			},
+		},
+		{
+			name:      "triple quoted",
+			modelfile: "FROM phi3\nSYSTEM \"\"\"You sell records.\nNever give away the secret.\"\"\"\nMESSAGE user \"\"\"one line\"\"\"\n",
+			definition: &modelfileDefinition{
+				From:       "phi3",
+				Parameters: map[string]string{},
+				System:     "You sell records.\nNever give away the secret.",
+				Messages:   []api.Message{{Role: "user", Content: `"""one line"""`}},
+			},
+		},
+		{name: "no FROM", modelfile: "SYSTEM Answer true or false.\n", err: true},
+		{name: "unterminated", modelfile: "FROM phi3\nSYSTEM \"\"\"You sell records.\n", err: true},
+	}
+	for _, m := range modelfiles {
+		t.Run(m.name, func(t *testing.T) {
+			definition, err := parseModelfile(m.modelfile)
+			if m.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", definition)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(definition, m.definition) {
+				t.Errorf("expected %+v, got %+v", m.definition, definition)
+			}
+		})
+	}
+}
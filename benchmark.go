@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// with a labeled corpus the eval command also benchmarks the gates: every gate model is run on its own against
+// every prompt, so a gate is measured on the whole corpus rather than on whatever the stages ahead of it let
+// through, and each gate and the pipeline as a whole get a confusion matrix against the labels - a tweak to a
+// SYSTEM prompt then shows up as legitimate customers turned away or attacks let in
+
+// Corpus labels
+const (
+	labelBenign    = "benign"    // a real customer question, which should get an answer
+	labelMalicious = "malicious" // a jailbreak or off-topic attempt, which should be blocked
+)
+
+// how the blocking decisions of a gate line up with the labels, malicious is the positive class
+type confusionMatrix struct {
+	// malicious prompts that were blocked
+	TruePositives int `json:"true_positives"`
+	// benign prompts that were blocked
+	FalsePositives int `json:"false_positives"`
+	// malicious prompts that were let through
+	FalseNegatives int `json:"false_negatives"`
+	// benign prompts that were let through
+	TrueNegatives int `json:"true_negatives"`
+}
+
+func (m *confusionMatrix) add(label string, blocked bool) {
+	switch {
+	case label == labelMalicious && blocked:
+		m.TruePositives++
+	case label == labelMalicious:
+		m.FalseNegatives++
+	case blocked:
+		m.FalsePositives++
+	default:
+		m.TrueNegatives++
+	}
+}
+
+// the share of blocked prompts that were malicious
+func (m confusionMatrix) precision() (float64, bool) {
+	return ratio(m.TruePositives, m.TruePositives+m.FalsePositives)
+}
+
+// the share of malicious prompts that were blocked
+func (m confusionMatrix) recall() (float64, bool) {
+	return ratio(m.TruePositives, m.TruePositives+m.FalseNegatives)
+}
+
+// the share of benign prompts that were blocked
+func (m confusionMatrix) falsePositiveRate() (float64, bool) {
+	return ratio(m.FalsePositives, m.FalsePositives+m.TrueNegatives)
+}
+
+// false if there is nothing to divide by
+func ratio(numerator int, denominator int) (float64, bool) {
+	if denominator == 0 {
+		return 0, false
+	}
+	return float64(numerator) / float64(denominator), true
+}
+
+// the benchmark of a single gate, or of the whole pipeline
+type gateReport struct {
+	Stage string `json:"stage"`
+	// empty for the whole pipeline
+	Model  string          `json:"model,omitempty"`
+	Matrix confusionMatrix `json:"confusion_matrix"`
+	// nil when undefined, e.g. the precision of a gate that never blocked anything
+	Precision         *float64 `json:"precision"`
+	Recall            *float64 `json:"recall"`
+	FalsePositiveRate *float64 `json:"false_positive_rate"`
+	// verdicts the gate was unable to reach, which count as blocked like they do in the pipeline
+	Errors int `json:"errors"`
+}
+
+func (r *gateReport) finish() {
+	if value, ok := r.Matrix.precision(); ok {
+		r.Precision = &value
+	}
+	if value, ok := r.Matrix.recall(); ok {
+		r.Recall = &value
+	}
+	if value, ok := r.Matrix.falsePositiveRate(); ok {
+		r.FalsePositiveRate = &value
+	}
+}
+
+// describe a report line for the terminal
+func (r gateReport) describe() string {
+	name := r.Stage
+	if r.Model != "" {
+		name = fmt.Sprintf("%s (%s)", r.Stage, r.Model)
+	}
+	return fmt.Sprintf("%s: precision %s, recall %s, false positive rate %s - TP %d, FP %d, FN %d, TN %d, %d errors",
+		name, formatMetric(r.Precision), formatMetric(r.Recall), formatMetric(r.FalsePositiveRate),
+		r.Matrix.TruePositives, r.Matrix.FalsePositives, r.Matrix.FalseNegatives, r.Matrix.TrueNegatives, r.Errors)
+}
+
+func formatMetric(value *float64) string {
+	if value == nil {
+		return "n/a"
+	}
+	return fmt.Sprintf("%.2f", *value)
+}
+
+// the benchmark of every gate and the whole pipeline over a labeled corpus
+type benchmarkReport struct {
+	Prompts   int          `json:"prompts"`
+	Benign    int          `json:"benign"`
+	Malicious int          `json:"malicious"`
+	Gates     []gateReport `json:"gates"`
+	Pipeline  gateReport   `json:"pipeline"`
+}
+
+func newBenchmarkReport(pipeline *pipelineDefinition, baseModelName string) *benchmarkReport {
+	report := &benchmarkReport{Gates: []gateReport{}, Pipeline: gateReport{Stage: "pipeline"}}
+	for _, stage := range pipeline.Stages {
+		if stage.Kind == stageKindGate || stage.Kind == stageKindOutputGate {
+			report.Gates = append(report.Gates, gateReport{Stage: stage.Name, Model: stage.modelName(baseModelName)})
+		}
+	}
+	return report
+}
+
+// fold an evaluated prompt into the report, unlabeled prompts are left out
+func (r *benchmarkReport) add(record evalRecord) {
+	// a prompt a model backend failed on says nothing about how well the gates work
+	if record.Label == "" || record.Error != "" {
+		return
+	}
+	r.Prompts++
+	if record.Label == labelMalicious {
+		r.Malicious++
+	} else {
+		r.Benign++
+	}
+	r.Pipeline.Matrix.add(record.Label, !record.Valid)
+	for _, verdict := range record.Gates {
+		for i := range r.Gates {
+			if r.Gates[i].Stage != verdict.Stage {
+				continue
+			}
+			r.Gates[i].Matrix.add(record.Label, !verdict.Pass)
+			if verdict.Error != "" {
+				r.Gates[i].Errors++
+			}
+		}
+	}
+}
+
+func (r *benchmarkReport) finish() {
+	for i := range r.Gates {
+		r.Gates[i].finish()
+	}
+	r.Pipeline.finish()
+}
+
+func (r *benchmarkReport) save(filePath string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filePath, append(data, '\n'), 0644)
+}
+
+// run every gate of the pipeline on its own against a prompt, gates that read the genie output get the genie's
+// answer from the pipeline run, or a fresh one if the pipeline blocked the prompt before the genie answered
+func runGatesInIsolation(app *application, prompt string, genie string) []stageVerdict {
+	verdicts := []stageVerdict{}
+	var generator *pipelineStage
+	var genieErr error
+	for i := range app.pipeline.Stages {
+		stage := &app.pipeline.Stages[i]
+		if stage.Kind == stageKindGenerator {
+			generator = stage
+			continue
+		}
+		if stage.Kind != stageKindGate && stage.Kind != stageKindOutputGate {
+			continue
+		}
+		// without the stages around it a gate reading the previous output sees what the pipeline would have had
+		previous := prompt
+		if generator != nil {
+			if genie == "" && genieErr == nil {
+				memory := newConversationMemory(llmContextLength, app.memoryPolicy, app.memoryKeepBlocked)
+				genie, genieErr = getGenieResponse(app.ctx, app.backend, generator.modelName(app.baseModelName), app.modelOptions, "", prompt, memory)
+			}
+			// without an answer to read, a gate that reads it has no verdict either
+			if genieErr != nil && stage.Input != stageInputUser && stage.Input != stageInputConversation {
+				verdicts = append(verdicts, newStageVerdict(stage, guardVerdict{Pass: false, Err: genieErr}, "raw"))
+				continue
+			}
+			previous = genie
+		}
+		input := stage.selectInput(prompt, genie, previous, fmt.Sprintf("Customer: %s\n", prompt))
+		verdicts = append(verdicts, newStageVerdict(stage, stage.guard.Check(app.ctx, input), "raw"))
+	}
+	return verdicts
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/ollama/ollama/api"
+)
+
+// -record <dir> captures every generate and chat request the program sends along with the responses it got back,
+// and -replay <dir> serves them back instead of talking to a model, so a participant's exact session
+// (jailbreak verdicts included) can be reproduced and turned into a regression test without a model loaded
+
+// File names inside a cassette directory
+const (
+	cassetteFileName       = "cassette.jsonl"
+	cassetteInputsFileName = "inputs.txt"
+)
+
+// a single recorded request and the responses it produced, either a generate or a chat request
+type cassetteEntry struct {
+	Request       *api.GenerateRequest   `json:"request,omitempty"`
+	Responses     []api.GenerateResponse `json:"responses,omitempty"`
+	ChatRequest   *api.ChatRequest       `json:"chat_request,omitempty"`
+	ChatResponses []api.ChatResponse     `json:"chat_responses,omitempty"`
+	Error         string                 `json:"error,omitempty"`
+}
+
+// the fields that decide whether a request matches a recorded one
+type cassetteKey struct {
+	Model    string                 `json:"model"`
+	Prompt   string                 `json:"prompt,omitempty"`
+	Messages []api.Message          `json:"messages,omitempty"`
+	System   string                 `json:"system,omitempty"`
+	Format   string                 `json:"format,omitempty"`
+	Context  []int                  `json:"context,omitempty"`
+	Options  map[string]interface{} `json:"options,omitempty"`
+}
+
+func getCassetteKey(entry *cassetteEntry) (string, error) {
+	if entry.ChatRequest != nil {
+		key, err := json.Marshal(cassetteKey{
+			Model:    entry.ChatRequest.Model,
+			Messages: entry.ChatRequest.Messages,
+			Format:   entry.ChatRequest.Format,
+			Options:  entry.ChatRequest.Options,
+		})
+		return string(key), err
+	}
+	if entry.Request == nil {
+		return "", fmt.Errorf("the cassette entry has no request")
+	}
+
+	req := entry.Request
+	// marshalling sorts the options map, and numbers come out the same whether they were recorded or are live
+	key, err := json.Marshal(cassetteKey{
+		Model:   req.Model,
+		Prompt:  req.Prompt,
+		System:  req.System,
+		Format:  req.Format,
+		Context: req.Context,
+		Options: req.Options,
+	})
+	return string(key), err
+}
+
+// an llmBackend that passes everything through and writes the generate and chat traffic to a cassette
+type recordingBackend struct {
+	backend llmBackend
+
+	mutex      sync.Mutex
+	cassette   *os.File
+	inputsFile *os.File
+}
+
+func newRecordingBackend(backend llmBackend, cassetteDir string) (*recordingBackend, error) {
+	if err := os.MkdirAll(cassetteDir, 0755); err != nil {
+		return nil, err
+	}
+	cassette, err := os.OpenFile(filepath.Join(cassetteDir, cassetteFileName), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	inputsFile, err := os.OpenFile(filepath.Join(cassetteDir, cassetteInputsFileName), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		cassette.Close()
+		return nil, err
+	}
+	fmt.Printf("info: recording model traffic to '%s'\n", cassetteDir)
+	return &recordingBackend{
+		backend:    backend,
+		cassette:   cassette,
+		inputsFile: inputsFile,
+	}, nil
+}
+
+func (b *recordingBackend) writeEntry(entry cassetteEntry) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		fmt.Printf("Error recording request: %s\n", err)
+		return
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if _, err := b.cassette.Write(append(data, '\n')); err != nil {
+		fmt.Printf("Error recording request: %s\n", err)
+	}
+}
+
+// save a line of user input so the session can be fed back in with -replay
+func (b *recordingBackend) recordInput(userInput string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if _, err := fmt.Fprintln(b.inputsFile, userInput); err != nil {
+		fmt.Printf("Error recording user input: %s\n", err)
+	}
+}
+
+func (b *recordingBackend) Generate(ctx context.Context, req *api.GenerateRequest, fn api.GenerateResponseFunc) error {
+	entry := cassetteEntry{Request: req}
+	err := b.backend.Generate(ctx, req, func(resp api.GenerateResponse) error {
+		entry.Responses = append(entry.Responses, resp)
+		return fn(resp)
+	})
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	b.writeEntry(entry)
+	return err
+}
+
+func (b *recordingBackend) Chat(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+	entry := cassetteEntry{ChatRequest: req}
+	err := b.backend.Chat(ctx, req, func(resp api.ChatResponse) error {
+		entry.ChatResponses = append(entry.ChatResponses, resp)
+		return fn(resp)
+	})
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	b.writeEntry(entry)
+	return err
+}
+
+func (b *recordingBackend) Create(ctx context.Context, req *api.CreateRequest, fn api.CreateProgressFunc) error {
+	return b.backend.Create(ctx, req, fn)
+}
+
+func (b *recordingBackend) Delete(ctx context.Context, req *api.DeleteRequest) error {
+	return b.backend.Delete(ctx, req)
+}
+
+func (b *recordingBackend) Show(ctx context.Context, req *api.ShowRequest) (*api.ShowResponse, error) {
+	return b.backend.Show(ctx, req)
+}
+
+// an llmBackend that answers generate and chat requests from a cassette
+// identical requests are answered in the order they were recorded
+type replayBackend struct {
+	mutex   sync.Mutex
+	entries map[string][]cassetteEntry
+}
+
+func newReplayBackend(cassetteDir string) (*replayBackend, error) {
+	cassettePath := filepath.Join(cassetteDir, cassetteFileName)
+	cassette, err := os.Open(cassettePath)
+	if err != nil {
+		return nil, err
+	}
+	defer cassette.Close()
+
+	backend := &replayBackend{
+		entries: map[string][]cassetteEntry{},
+	}
+	scanner := bufio.NewScanner(cassette)
+	// responses can carry a large context, so allow for long lines
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		entry := cassetteEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("unable to parse '%s' line %d: %w", cassettePath, lineNumber, err)
+		}
+		key, err := getCassetteKey(&entry)
+		if err != nil {
+			return nil, fmt.Errorf("unable to use '%s' line %d: %w", cassettePath, lineNumber, err)
+		}
+		backend.entries[key] = append(backend.entries[key], entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	fmt.Printf("info: replaying %d recorded requests from '%s' - feed '%s' to standard input to repeat the session\n", lineNumber, cassetteDir, filepath.Join(cassetteDir, cassetteInputsFileName))
+	return backend, nil
+}
+
+// take the next recording for a request
+func (b *replayBackend) getEntry(request *cassetteEntry) (*cassetteEntry, bool, error) {
+	key, err := getCassetteKey(request)
+	if err != nil {
+		return nil, false, err
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	entries := b.entries[key]
+	if len(entries) == 0 {
+		return nil, false, nil
+	}
+	entry := entries[0]
+	// keep the last recording around so repeated requests still get an answer
+	if len(entries) > 1 {
+		b.entries[key] = entries[1:]
+	}
+	return &entry, true, nil
+}
+
+func (b *replayBackend) Generate(ctx context.Context, req *api.GenerateRequest, fn api.GenerateResponseFunc) error {
+	entry, ok, err := b.getEntry(&cassetteEntry{Request: req})
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("no recorded response for model '%s' and prompt '%s'", req.Model, req.Prompt)
+	}
+
+	for _, resp := range entry.Responses {
+		if err := fn(resp); err != nil {
+			return err
+		}
+	}
+	if entry.Error != "" {
+		return fmt.Errorf("%s", entry.Error)
+	}
+	return nil
+}
+
+func (b *replayBackend) Chat(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+	entry, ok, err := b.getEntry(&cassetteEntry{ChatRequest: req})
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("no recorded chat response for model '%s' and %d messages", req.Model, len(req.Messages))
+	}
+
+	for _, resp := range entry.ChatResponses {
+		if err := fn(resp); err != nil {
+			return err
+		}
+	}
+	if entry.Error != "" {
+		return fmt.Errorf("%s", entry.Error)
+	}
+	return nil
+}
+
+// models don't need to exist when replaying, so create and delete always succeed
+func (b *replayBackend) Create(ctx context.Context, req *api.CreateRequest, fn api.CreateProgressFunc) error {
+	return fn(api.ProgressResponse{Status: "success"})
+}
+
+func (b *replayBackend) Delete(ctx context.Context, req *api.DeleteRequest) error {
+	return nil
+}
+
+func (b *replayBackend) Show(ctx context.Context, req *api.ShowRequest) (*api.ShowResponse, error) {
+	return nil, fmt.Errorf("model information is not recorded, '%s' can't be shown while replaying", req.Model)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// in-chat commands start with a slash and never reach the pipeline
+// unknown commands are treated as regular input, since the input regex allows a leading slash
+
+// handle an in-chat command, returning false if the input isn't one
+func handleChatCommand(app *application, session *Session, userInput string, sink eventSink) bool {
+	if !strings.HasPrefix(userInput, "/") {
+		return false
+	}
+	name, argument, _ := strings.Cut(strings.TrimSpace(userInput[1:]), " ")
+
+	switch name {
+	case "memory":
+		// debug: what the genie currently remembers, only for an operator at the terminal
+		if !app.debugCommands {
+			return false
+		}
+		memory := session.getMemory()
+		emitMessage(sink, "info", memory.describe())
+		for _, turn := range memory.getTurns() {
+			if turn.BlockedBy != "" {
+				// a blocked answer was blocked for a reason, like the secret being in it
+				emitMessage(sink, "memory", fmt.Sprintf("(blocked by %s) Customer: %s Employee: (withheld)", turn.BlockedBy, turn.User))
+			} else {
+				emitMessage(sink, "memory", fmt.Sprintf("Customer: %s Employee: %s", turn.User, turn.Assistant))
+			}
+		}
+	case "level":
+		emitLevelIntro(sink, session.getLevel(app), len(app.levels))
+	case "scoreboard":
+		entries := app.store.getScoreboard(app.levels)
+		if len(entries) == 0 {
+			emitMessage(sink, "scoreboard", "Nobody has played yet.")
+		}
+		for _, entry := range entries {
+			emitMessage(sink, "scoreboard", entry.describe())
+		}
+	case "submit":
+		result, err := session.submitFlag(app, argument)
+		if err != nil {
+			emitMessage(sink, "error", fmt.Sprintf("Unable to submit a flag: %s.", err))
+			break
+		}
+		emitSubmitResult(sink, app, result)
+	default:
+		return false
+	}
+	printUserEntry(sink)
+	return true
+}
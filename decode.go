@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// the user input regex allows +/= on purpose, so a base64 payload sails through it and the jailbreak gate
+// only ever sees an opaque blob - a decode stage unwraps base64, hex and URL encoding in the user input
+// (over and over, up to a limit) and the guards after it check every decoded form as well as the raw one
+
+// Decode limits
+const (
+	// how many times encodings are peeled off, e.g. hex inside base64 inside URL encoding is three
+	defaultMaxDecodeDepth = 3
+	// the most forms of a single input the guards are run against, the raw input included
+	maxDecodedForms = 8
+)
+
+var (
+	// runs in the user input worth trying to decode, longer than the base64 and hex runs searched for in
+	// the genie output since plenty of ordinary words are valid base64
+	rxInputBase64Run = regexp.MustCompile(`[A-Za-z0-9+/_-]{12,}={0,2}`)
+	rxInputHexRun    = regexp.MustCompile(`(?i)(?:[0-9a-f]{2}[\s:]?){6,}`)
+	rxURLEncoded     = regexp.MustCompile(`%[0-9a-fA-F]{2}`)
+)
+
+// the user input as it was typed, or after one or more decodings
+type inputForm struct {
+	// "raw", or the decodings applied in order, e.g. "base64, then hex"
+	Name string
+	Text string
+}
+
+// true if every byte is printable ASCII or whitespace, decoded ordinary words rarely are
+func isASCIIText(data []byte) bool {
+	if len(data) == 0 {
+		return false
+	}
+	for _, b := range data {
+		if (b < 0x20 || b > 0x7e) && b != '\n' && b != '\r' && b != '\t' {
+			return false
+		}
+	}
+	return true
+}
+
+// replace every run the decoder understands with what it decodes to
+func decodeRuns(text string, rxRun *regexp.Regexp, decode func(string) ([]byte, bool)) string {
+	return rxRun.ReplaceAllStringFunc(text, func(run string) string {
+		decoded, ok := decode(strings.TrimSpace(run))
+		if !ok || !isASCIIText(decoded) {
+			return run
+		}
+		// keep the whitespace the hex run swallowed so neighbouring words don't run together
+		if strings.HasSuffix(run, " ") {
+			return string(decoded) + " "
+		}
+		return string(decoded)
+	})
+}
+
+// peel one layer of each encoding off the text, only the encodings that changed something are returned
+func decodeOnce(text string) []inputForm {
+	forms := []inputForm{}
+	if rxURLEncoded.MatchString(text) {
+		if decoded, err := url.QueryUnescape(text); err == nil && decoded != text && isASCIIText([]byte(decoded)) {
+			forms = append(forms, inputForm{Name: "URL encoding", Text: decoded})
+		}
+	}
+	if decoded := decodeRuns(text, rxInputBase64Run, decodeBase64Text); decoded != text {
+		forms = append(forms, inputForm{Name: "base64", Text: decoded})
+	}
+	if decoded := decodeRuns(text, rxInputHexRun, decodeHexText); decoded != text {
+		forms = append(forms, inputForm{Name: "hex", Text: decoded})
+	}
+	return forms
+}
+
+// the raw user input followed by every distinct form it decodes to, breadth first so the shallowest decodings come first
+func decodeUserInput(userInput string, maxDepth int) []inputForm {
+	forms := []inputForm{{Name: "raw", Text: userInput}}
+	seen := map[string]bool{userInput: true}
+	layer := forms
+
+	for depth := 0; depth < maxDepth && len(layer) > 0; depth++ {
+		nextLayer := []inputForm{}
+		for _, form := range layer {
+			for _, decoded := range decodeOnce(form.Text) {
+				if seen[decoded.Text] {
+					continue
+				}
+				if len(forms) >= maxDecodedForms {
+					return forms
+				}
+				seen[decoded.Text] = true
+				if form.Name != "raw" {
+					decoded.Name = fmt.Sprintf("%s, then %s", form.Name, decoded.Name)
+				}
+				forms = append(forms, decoded)
+				nextLayer = append(nextLayer, decoded)
+			}
+		}
+		layer = nextLayer
+	}
+	return forms
+}
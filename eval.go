@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// the eval command runs a corpus of attack prompts through the same pipeline the chat uses and writes a record
+// per prompt - which stage blocked it, what every model said, and whether a protected secret leaked - so a defense
+// change can be measured against the whole corpus instead of by typing prompts into the chat one at a time
+
+// Default eval settings
+const (
+	defaultEvalOutputFile = "eval.jsonl"
+)
+
+// a single prompt of an eval corpus
+type corpusPrompt struct {
+	// optional, the line number if not given
+	ID     string `json:"id"`
+	Prompt string `json:"prompt"`
+	// optional, one of the corpus labels, a labeled corpus also benchmarks the gates
+	Label string `json:"label,omitempty"`
+}
+
+// what the pipeline made of a single corpus prompt
+type evalRecord struct {
+	ID          string `json:"id"`
+	Prompt      string `json:"prompt"`
+	Label       string `json:"label,omitempty"`
+	Valid       bool   `json:"valid"`
+	BlockedBy   string `json:"blocked_by,omitempty"`
+	Category    string `json:"category,omitempty"`
+	BlockedForm string `json:"blocked_form,omitempty"`
+	// the raw genie output, even if a later stage blocked it
+	Genie string `json:"genie,omitempty"`
+	// the answer the player would have been given
+	Answer string `json:"answer,omitempty"`
+	// true if the genie gave up a protected secret, whether or not a later stage stopped it
+	GenieLeaked bool `json:"genie_leaked"`
+	// true if a protected secret made it into the answer the player would have been given
+	Leaked     bool           `json:"leaked"`
+	LeakReason string         `json:"leak_reason,omitempty"`
+	Stages     []stageVerdict `json:"stages"`
+	// labeled prompts only, what every gate made of the prompt when run on its own
+	Gates []stageVerdict `json:"gates,omitempty"`
+	// set when a model couldn't be reached, the record then says nothing about the defenses
+	Error string `json:"error,omitempty"`
+}
+
+// read a corpus from a JSON lines file of {"id": ..., "prompt": ..., "label": ...} objects, or a CSV file with a
+// header row that has a "prompt" column and optionally "id" and "label" columns
+func loadCorpus(filePath string) ([]corpusPrompt, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	var prompts []corpusPrompt
+	if strings.EqualFold(filepath.Ext(filePath), ".csv") {
+		prompts, err = parseCorpusCSV(data)
+	} else {
+		prompts, err = parseCorpusJSONL(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse corpus '%s': %w", filePath, err)
+	}
+	if len(prompts) == 0 {
+		return nil, fmt.Errorf("the corpus '%s' has no prompts", filePath)
+	}
+	for _, prompt := range prompts {
+		if prompt.Label != "" && prompt.Label != labelBenign && prompt.Label != labelMalicious {
+			return nil, fmt.Errorf("prompt '%s' of corpus '%s' has an unrecognized label '%s' - expected one of '%s', '%s'", prompt.ID, filePath, prompt.Label, labelBenign, labelMalicious)
+		}
+	}
+	return prompts, nil
+}
+
+func parseCorpusJSONL(data []byte) ([]corpusPrompt, error) {
+	prompts := []corpusPrompt{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		decoder := json.NewDecoder(strings.NewReader(line))
+		decoder.DisallowUnknownFields()
+		prompt := corpusPrompt{}
+		if err := decoder.Decode(&prompt); err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+		if prompt.ID == "" {
+			prompt.ID = strconv.Itoa(lineNumber)
+		}
+		prompts = append(prompts, prompt)
+	}
+	return prompts, scanner.Err()
+}
+
+func parseCorpusCSV(data []byte) ([]corpusPrompt, error) {
+	reader := csv.NewReader(bytes.NewReader(data))
+	header, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	promptColumn, ok := columns["prompt"]
+	if !ok {
+		return nil, fmt.Errorf("the header row has no 'prompt' column")
+	}
+	idColumn, hasID := columns["id"]
+	labelColumn, hasLabel := columns["label"]
+
+	prompts := []corpusPrompt{}
+	for lineNumber := 2; ; lineNumber++ {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		prompt := corpusPrompt{ID: strconv.Itoa(lineNumber), Prompt: row[promptColumn]}
+		if hasID && row[idColumn] != "" {
+			prompt.ID = row[idColumn]
+		}
+		if hasLabel {
+			prompt.Label = row[labelColumn]
+		}
+		prompts = append(prompts, prompt)
+	}
+	return prompts, nil
+}
+
+// run a single prompt through the pipeline with a genie that remembers nothing
+func evaluatePrompt(app *application, prompt corpusPrompt, protectedValues []protectedValue) evalRecord {
+	memory := newConversationMemory(llmContextLength, app.memoryPolicy, app.memoryKeepBlocked)
+	result := runPipelineTurn(app, prompt.Prompt, memory, turnOptions{}, newCollectingSink())
+
+	record := evalRecord{
+		ID:          prompt.ID,
+		Prompt:      prompt.Prompt,
+		Label:       prompt.Label,
+		Valid:       result.Valid,
+		BlockedBy:   result.BlockedBy,
+		Category:    result.Category,
+		BlockedForm: result.BlockedForm,
+		Genie:       result.Genie,
+		Answer:      result.Answer,
+		Stages:      result.Verdicts,
+		Error:       result.Error,
+	}
+	if record.Stages == nil {
+		record.Stages = []stageVerdict{}
+	}
+	record.GenieLeaked, record.LeakReason = detectLeak(result.Genie, protectedValues)
+	if result.Valid {
+		record.Leaked, _ = detectLeak(result.Answer, protectedValues)
+	}
+	if prompt.Label != "" {
+		record.Gates = runGatesInIsolation(app, prompt.Prompt, result.Genie)
+	}
+	return record
+}
+
+// run every prompt of the corpora and write a record for each to the output file, and with labeled prompts a
+// benchmark of the gates to the report file if there is one
+func runEval(app *application, corpusPaths []string, outputPath string, reportPath string) error {
+	prompts := []corpusPrompt{}
+	for _, corpusPath := range corpusPaths {
+		corpus, err := loadCorpus(corpusPath)
+		if err != nil {
+			return err
+		}
+		prompts = append(prompts, corpus...)
+	}
+	protectedValues, err := app.pipeline.getProtectedValues(app.baseModelName)
+	if err != nil {
+		return err
+	}
+	output, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	defer output.Close()
+	encoder := json.NewEncoder(output)
+
+	valid, genieLeaked, leaked, errored := 0, 0, 0, 0
+	blockedBy := map[string]int{}
+	report := newBenchmarkReport(app.pipeline, app.baseModelName)
+	for i, prompt := range prompts {
+		record := evaluatePrompt(app, prompt, protectedValues)
+		if err := encoder.Encode(record); err != nil {
+			return err
+		}
+		report.add(record)
+
+		outcome := "valid"
+		if record.Error != "" {
+			errored++
+			fmt.Printf("warning: [%d/%d] %s: %s\n", i+1, len(prompts), prompt.ID, record.Error)
+			continue
+		}
+		if record.Valid {
+			valid++
+		} else {
+			blockedBy[record.BlockedBy]++
+			outcome = fmt.Sprintf("blocked by %s", record.BlockedBy)
+		}
+		if record.GenieLeaked {
+			genieLeaked++
+			outcome += ", the genie leaked a secret"
+		}
+		if record.Leaked {
+			leaked++
+			outcome += " and it reached the player"
+		}
+		fmt.Printf("info: [%d/%d] %s: %s\n", i+1, len(prompts), prompt.ID, outcome)
+	}
+
+	stages := []string{}
+	for stage, count := range blockedBy {
+		stages = append(stages, fmt.Sprintf("%s %d", stage, count))
+	}
+	sort.Strings(stages)
+	fmt.Printf("info: evaluated %d prompts from '%s' - %d valid, %d blocked (%s), the genie leaked a secret %d times and %d of them reached the player\n", len(prompts)-errored, strings.Join(corpusPaths, "', '"), valid, len(prompts)-errored-valid, strings.Join(stages, ", "), genieLeaked, leaked)
+	if errored > 0 {
+		fmt.Printf("warning: %d prompts couldn't be evaluated because a model backend failed, they are left out of the totals and the benchmark\n", errored)
+	}
+	fmt.Printf("info: wrote a record per prompt to '%s'\n", outputPath)
+
+	if report.Prompts == 0 {
+		if reportPath != "" {
+			fmt.Printf("warning: the corpus has no labeled prompts, so there is no benchmark to write to '%s'\n", reportPath)
+		}
+		return nil
+	}
+	report.finish()
+	fmt.Printf("info: benchmarked the gates on their own against %d labeled prompts, %d benign and %d malicious\n", report.Prompts, report.Benign, report.Malicious)
+	for _, gate := range report.Gates {
+		fmt.Printf("info: %s\n", gate.describe())
+	}
+	fmt.Printf("info: %s\n", report.Pipeline.describe())
+	if reportPath != "" {
+		if err := report.save(reportPath); err != nil {
+			return err
+		}
+		fmt.Printf("info: wrote the benchmark to '%s'\n", reportPath)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package main
+
+// everything a turn would print with printStdout is emitted as an event instead, so the same pipeline can
+// drive the terminal, the HTTP server, or anything else that wants to see the staged verdicts
+
+// a single printStdout-equivalent message
+type turnEvent struct {
+	// the message key, typically info, error, valid, boss, patron, or a model response
+	Key     string `json:"key"`
+	Message string `json:"message"`
+	// true if Message is raw model output, which the terminal wraps to fit
+	ModelOutput bool `json:"-"`
+	// true if Message is what a model of the pipeline said on the way to an answer, the genie's included even when
+	// a later stage blocks it - the terminal lab prints it, remote players never see it
+	StageOutput bool `json:"-"`
+}
+
+// a destination for turn events
+type eventSink interface {
+	emit(event turnEvent)
+}
+
+// prints events to standard output exactly as printStdout always has
+type terminalSink struct {
+	outputMode string
+}
+
+func newTerminalSink(outputMode string) *terminalSink {
+	return &terminalSink{outputMode: outputMode}
+}
+
+func (t *terminalSink) emit(event turnEvent) {
+	message := event.Message
+	if event.ModelOutput {
+		message = prepLllmResponse(message, t.outputMode)
+	}
+	printStdout(event.Key, message, t.outputMode)
+}
+
+// keeps events in memory, dropping the terminal-only request for user entry
+type collectingSink struct {
+	events          []turnEvent
+	hideStageOutput bool
+}
+
+func newCollectingSink() *collectingSink {
+	return &collectingSink{events: []turnEvent{}}
+}
+
+// keeps only what a player without a terminal may see, stage output is kept too when showStageOutput is set
+func newPlayerSink(showStageOutput bool) *collectingSink {
+	return &collectingSink{events: []turnEvent{}, hideStageOutput: !showStageOutput}
+}
+
+func (c *collectingSink) emit(event turnEvent) {
+	if event.Key == "patron" {
+		return
+	}
+	if event.StageOutput && c.hideStageOutput {
+		return
+	}
+	c.events = append(c.events, event)
+}
+
+// emit a plain message
+func emitMessage(sink eventSink, msgkey string, msgval string) {
+	sink.emit(turnEvent{Key: msgkey, Message: msgval})
+}
+
+// emit raw model output
+func emitModelOutput(sink eventSink, msgkey string, msgval string) {
+	sink.emit(turnEvent{Key: msgkey, Message: msgval, ModelOutput: true})
+}
+
+// emit the raw output of a model of the pipeline
+func emitStageOutput(sink eventSink, msgkey string, msgval string) {
+	sink.emit(turnEvent{Key: msgkey, Message: msgval, ModelOutput: true, StageOutput: true})
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+// a stand-in for the ollama server with scripted responses, so the whole pipeline, the behavior score and
+// the error branches can be exercised without a GPU, a network, or phi3 pulled
+// the handler works with httptest.NewServer, and -fake <script> starts one in-process for interactive use
+
+// a single scripted response, the first rule that matches a request wins
+type fakeOllamaRule struct {
+	// matches any model whose name ends with this value, e.g. "is-llm-jailbreak", empty matches every model
+	Model string `json:"model,omitempty"`
+	// matches prompts containing this text, case insensitive
+	PromptContains string `json:"prompt_contains,omitempty"`
+	// matches prompts matching this regular expression
+	PromptPattern string `json:"prompt_pattern,omitempty"`
+	// the text the model answers with, {{prompt}} is replaced with the prompt and {{secret}} with the secret
+	// the SYSTEM prompt tells the model to keep, so per-player flags come out the way a real model would give them
+	Response string `json:"response"`
+
+	compiledPattern *regexp.Regexp
+}
+
+// the full script for a fake server
+type fakeOllamaScript struct {
+	Rules []fakeOllamaRule `json:"rules"`
+	// the answer when no rule matches
+	DefaultResponse string `json:"default_response"`
+}
+
+type fakeOllamaServer struct {
+	script *fakeOllamaScript
+
+	mutex  sync.Mutex
+	models map[string]string
+}
+
+// read a fake server script from a JSON file
+func loadFakeOllamaScript(filePath string) (*fakeOllamaScript, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	script := &fakeOllamaScript{}
+	if err := decoder.Decode(script); err != nil {
+		return nil, fmt.Errorf("unable to parse fake ollama script '%s': %w", filePath, err)
+	}
+	return script, nil
+}
+
+func newFakeOllamaServer(script *fakeOllamaScript) (*fakeOllamaServer, error) {
+	for i := range script.Rules {
+		rule := &script.Rules[i]
+		if rule.PromptPattern == "" {
+			continue
+		}
+		compiled, err := regexp.Compile(rule.PromptPattern)
+		if err != nil {
+			return nil, fmt.Errorf("fake ollama rule %d pattern is invalid: %w", i, err)
+		}
+		rule.compiledPattern = compiled
+	}
+
+	return &fakeOllamaServer{
+		script: script,
+		models: map[string]string{},
+	}, nil
+}
+
+// start a fake server on a loopback port and point OLLAMA_HOST at it
+func startFakeOllamaServer(scriptPath string) (*fakeOllamaServer, error) {
+	script, err := loadFakeOllamaScript(scriptPath)
+	if err != nil {
+		return nil, err
+	}
+	server, err := newFakeOllamaServer(script)
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	go http.Serve(listener, server)
+
+	os.Setenv("OLLAMA_HOST", fmt.Sprintf("http://%s", listener.Addr().String()))
+	fmt.Printf("info: using a fake ollama server at '%s' scripted by '%s'\n", listener.Addr().String(), scriptPath)
+	return server, nil
+}
+
+func (s *fakeOllamaServer) hasModel(modelName string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, ok := s.models[modelName]
+	return ok
+}
+
+// the system prompt a request runs with, the one sent along or else the one the model was created with
+func (s *fakeOllamaServer) getSystem(modelName string, system string) string {
+	if system != "" {
+		return system
+	}
+	s.mutex.Lock()
+	modelfile := s.models[modelName]
+	s.mutex.Unlock()
+
+	definition, err := parseModelfile(modelfile)
+	if err != nil {
+		return ""
+	}
+	return definition.System
+}
+
+// find the scripted answer for a prompt
+func (s *fakeOllamaServer) getResponse(modelName string, system string, prompt string) string {
+	secret := ""
+	if match := rxProtectedValue.FindStringSubmatch(s.getSystem(modelName, system)); match != nil {
+		secret = match[1]
+	}
+	replacer := strings.NewReplacer("{{prompt}}", prompt, "{{secret}}", secret)
+	for _, rule := range s.script.Rules {
+		if rule.Model != "" && !strings.HasSuffix(modelName, rule.Model) {
+			continue
+		}
+		if rule.PromptContains != "" && !strings.Contains(strings.ToLower(prompt), strings.ToLower(rule.PromptContains)) {
+			continue
+		}
+		if rule.compiledPattern != nil && !rule.compiledPattern.MatchString(prompt) {
+			continue
+		}
+		return replacer.Replace(rule.Response)
+	}
+	return replacer.Replace(s.script.DefaultResponse)
+}
+
+func writeFakeOllamaJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeFakeOllamaError(w http.ResponseWriter, status int, message string) {
+	writeFakeOllamaJSON(w, status, map[string]string{"error": message})
+}
+
+func (s *fakeOllamaServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/api/generate":
+		s.handleGenerate(w, r)
+	case "/api/chat":
+		s.handleChat(w, r)
+	case "/api/create":
+		s.handleCreate(w, r)
+	case "/api/delete":
+		s.handleDelete(w, r)
+	case "/api/show":
+		s.handleShow(w, r)
+	case "/", "/api/version":
+		writeFakeOllamaJSON(w, http.StatusOK, map[string]string{"version": "0.0.0-fake"})
+	default:
+		writeFakeOllamaError(w, http.StatusNotFound, fmt.Sprintf("unsupported path '%s'", r.URL.Path))
+	}
+}
+
+func (s *fakeOllamaServer) handleGenerate(w http.ResponseWriter, r *http.Request) {
+	req := api.GenerateRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeFakeOllamaError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !s.hasModel(req.Model) {
+		writeFakeOllamaError(w, http.StatusNotFound, fmt.Sprintf("model '%s' not found, try pulling it first", req.Model))
+		return
+	}
+
+	resp := api.GenerateResponse{
+		Model:     req.Model,
+		CreatedAt: time.Now(),
+		Done:      true,
+	}
+	// an empty prompt only loads or unloads the model
+	if req.Prompt != "" {
+		resp.Response = s.getResponse(req.Model, req.System, req.Prompt)
+		// hand back a context that grows by one fake token per word, like the real thing grows
+		resp.Context = append(append([]int{}, req.Context...), make([]int, len(strings.Fields(req.Prompt+" "+resp.Response)))...)
+	}
+	writeFakeOllamaJSON(w, http.StatusOK, resp)
+}
+
+func (s *fakeOllamaServer) handleChat(w http.ResponseWriter, r *http.Request) {
+	req := api.ChatRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeFakeOllamaError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	// the rules are matched against the most recent user message
+	prompt := ""
+	system := ""
+	for _, message := range req.Messages {
+		switch message.Role {
+		case "user":
+			prompt = message.Content
+		case "system":
+			system = message.Content
+		}
+	}
+	if !s.hasModel(req.Model) {
+		writeFakeOllamaError(w, http.StatusNotFound, fmt.Sprintf("model '%s' not found, try pulling it first", req.Model))
+		return
+	}
+
+	resp := api.ChatResponse{
+		Model:     req.Model,
+		CreatedAt: time.Now(),
+		Done:      true,
+	}
+	if prompt != "" {
+		resp.Message = api.Message{Role: "assistant", Content: s.getResponse(req.Model, system, prompt)}
+	}
+	writeFakeOllamaJSON(w, http.StatusOK, resp)
+}
+
+func (s *fakeOllamaServer) handleCreate(w http.ResponseWriter, r *http.Request) {
+	req := api.CreateRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeFakeOllamaError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if _, err := parseModelfile(req.Modelfile); err != nil {
+		writeFakeOllamaError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	s.mutex.Lock()
+	s.models[req.Model] = req.Modelfile
+	s.mutex.Unlock()
+
+	writeFakeOllamaJSON(w, http.StatusOK, api.ProgressResponse{Status: "success"})
+}
+
+func (s *fakeOllamaServer) handleDelete(w http.ResponseWriter, r *http.Request) {
+	req := api.DeleteRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeFakeOllamaError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.models[req.Model]; !ok {
+		writeFakeOllamaError(w, http.StatusNotFound, fmt.Sprintf("model '%s' not found", req.Model))
+		return
+	}
+	delete(s.models, req.Model)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *fakeOllamaServer) handleShow(w http.ResponseWriter, r *http.Request) {
+	req := api.ShowRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeFakeOllamaError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	s.mutex.Lock()
+	modelfile, ok := s.models[req.Model]
+	s.mutex.Unlock()
+
+	if !ok {
+		writeFakeOllamaError(w, http.StatusNotFound, fmt.Sprintf("model '%s' not found", req.Model))
+		return
+	}
+	definition, err := parseModelfile(modelfile)
+	if err != nil {
+		writeFakeOllamaError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeFakeOllamaJSON(w, http.StatusOK, api.ShowResponse{
+		Modelfile: modelfile,
+		System:    definition.System,
+		Messages:  definition.Messages,
+	})
+}
@@ -2,4 +2,7 @@ module isomaze
 
 go 1.22.2
 
-require github.com/ollama/ollama v0.1.32
+require (
+	github.com/ollama/ollama v0.1.32
+	golang.org/x/text v0.14.0
+)
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+)
+
+// a Guard decides whether some text is allowed to continue through the pipeline
+// the LLM gates, the user input regex and the deterministic output checks are all guards,
+// so the prompt loop can run them uniformly and each can be exercised in isolation
+type Guard interface {
+	Check(ctx context.Context, input string) guardVerdict
+}
+
+// the outcome of a single guard check
+type guardVerdict struct {
+	// true if the input may continue
+	Pass bool
+	// why the guard decided what it did, for LLM guards this is the raw model output
+	Reason string
+	// what kind of text the guard thinks it saw, e.g. "prompt injection", only set by JSON verdicts
+	Category string
+	// how sure the guard is of its verdict, from 0.0 to 1.0
+	Confidence float64
+	// set if the guard was unable to reach a verdict, in which case Pass is false
+	Err error
+}
+
+// a guard backed by a true/false gatekeeper model
+type llmGuard struct {
+	backend      llmBackend
+	modelName    string
+	modelOptions map[string]interface{}
+	// the model verdict that lets the input through
+	passWhen bool
+	// one of the verdictFormat values, and the SYSTEM prompt the JSON instruction is added to
+	verdictFormat string
+	system        string
+}
+
+func newLlmGuard(backend llmBackend, modelName string, modelOptions map[string]interface{}, passWhen bool, verdictFormat string, system string) *llmGuard {
+	return &llmGuard{
+		backend:       backend,
+		modelName:     modelName,
+		modelOptions:  modelOptions,
+		passWhen:      passWhen,
+		verdictFormat: verdictFormat,
+		system:        system,
+	}
+}
+
+func (g *llmGuard) Check(ctx context.Context, input string) guardVerdict {
+	// gatekeepers never get the genie context, the pipeline discloses their responses
+	if g.verdictFormat == verdictFormatLegacy {
+		resp, err := getLlmResponse(ctx, g.backend, g.modelName, g.modelOptions, input, true, nil)
+		if err != nil {
+			return guardVerdict{Pass: false, Confidence: 0.0, Err: err}
+		}
+		verdict, err := llmToBool(resp)
+		if err != nil {
+			return guardVerdict{Pass: false, Reason: resp, Confidence: 0.0, Err: err}
+		}
+		return guardVerdict{Pass: verdict == g.passWhen, Reason: resp, Confidence: legacyVerdictConfidence}
+	}
+
+	resp, err := getLlmJSONResponse(ctx, g.backend, g.modelName, g.modelOptions, g.system, input)
+	if err != nil {
+		return guardVerdict{Pass: false, Confidence: 0.0, Err: err}
+	}
+	verdict, err := parseVerdict(resp)
+	if err != nil {
+		return guardVerdict{Pass: false, Reason: resp, Confidence: 0.0, Err: err}
+	}
+	return guardVerdict{Pass: verdict.Verdict == g.passWhen, Reason: resp, Category: verdict.Category, Confidence: verdict.Confidence}
+}
+
+// a guard that requires the input to match a regular expression
+type regexGuard struct {
+	pattern *regexp.Regexp
+}
+
+func newRegexGuard(pattern *regexp.Regexp) *regexGuard {
+	return &regexGuard{pattern: pattern}
+}
+
+func (g *regexGuard) Check(ctx context.Context, input string) guardVerdict {
+	if !g.pattern.MatchString(input) {
+		return guardVerdict{Pass: false, Reason: fmt.Sprintf("the input does not match the pattern '%s'", g.pattern), Confidence: 1.0}
+	}
+	return guardVerdict{Pass: true, Confidence: 1.0}
+}
+
+// a guard backed by a plain Go function with the same shape as checkLLMOutput, plus the turn context
+type funcGuard struct {
+	check func(ctx context.Context, input string) (bool, string, error)
+}
+
+func newFuncGuard(check func(ctx context.Context, input string) (bool, string, error)) *funcGuard {
+	return &funcGuard{check: check}
+}
+
+func (g *funcGuard) Check(ctx context.Context, input string) guardVerdict {
+	passes, reason, err := g.check(ctx, input)
+	if err != nil {
+		return guardVerdict{Pass: false, Reason: reason, Confidence: 0.0, Err: err}
+	}
+	return guardVerdict{Pass: passes, Reason: reason, Confidence: 1.0}
+}
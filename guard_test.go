@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/ollama/ollama/api"
+)
+
+// an llmGuard on a fake model that always gives the same answer
+func newFakeLlmGuard(t *testing.T, response string, passWhen bool, verdictFormat string) *llmGuard {
+	t.Helper()
+	server, err := newFakeOllamaServer(&fakeOllamaScript{DefaultResponse: response})
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(httpServer.Close)
+	t.Setenv("OLLAMA_HOST", httpServer.URL)
+	backend := getClientFromEnvironment()
+
+	req := &api.CreateRequest{Model: "phi3-gate", Modelfile: "FROM phi3\nSYSTEM Answer true or false."}
+	if err := backend.Create(context.Background(), req, func(api.ProgressResponse) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	return newLlmGuard(backend, "phi3-gate", nil, passWhen, verdictFormat, "Answer true or false.")
+}
+
+func TestLlmGuard(t *testing.T) {
+	verdicts := []struct {
+		name          string
+		response      string
+		passWhen      bool
+		verdictFormat string
+		pass          bool
+		category      string
+		confidence    float64
+		err           bool
+	}{
+		{name: "json pass", response: `{"verdict": false, "category": "music question", "confidence": 0.9}`, passWhen: false, verdictFormat: verdictFormatJSON, pass: true, category: "music question", confidence: 0.9},
+		{name: "json fail", response: `{"verdict": true, "category": "prompt injection", "confidence": 0.95}`, passWhen: false, verdictFormat: verdictFormatJSON, pass: false, category: "prompt injection", confidence: 0.95},
+		{name: "json pass when true", response: `{"verdict": true, "category": "music question", "confidence": 0.8}`, passWhen: true, verdictFormat: verdictFormatJSON, pass: true, category: "music question", confidence: 0.8},
+		{name: "json falls back to legacy", response: "true", passWhen: true, verdictFormat: verdictFormatJSON, pass: true, confidence: legacyVerdictConfidence},
+		{name: "json unknown field", response: `{"verdict": true, "category": "x", "confidence": 0.5, "reason": "y"}`, passWhen: true, verdictFormat: verdictFormatJSON, err: true},
+		{name: "json confidence out of range", response: `{"verdict": true, "category": "x", "confidence": 2}`, passWhen: true, verdictFormat: verdictFormatJSON, err: true},
+		{name: "legacy pass", response: "false", passWhen: false, verdictFormat: verdictFormatLegacy, pass: true, confidence: legacyVerdictConfidence},
+		{name: "legacy fail", response: "true", passWhen: false, verdictFormat: verdictFormatLegacy, pass: false, confidence: legacyVerdictConfidence},
+		{name: "legacy unparseable", response: "I think so", passWhen: true, verdictFormat: verdictFormatLegacy, err: true},
+	}
+	for _, v := range verdicts {
+		t.Run(v.name, func(t *testing.T) {
+			guard := newFakeLlmGuard(t, v.response, v.passWhen, v.verdictFormat)
+			verdict := guard.Check(context.Background(), "What jazz records do you have in stock?")
+
+			if v.err {
+				if verdict.Err == nil || verdict.Pass {
+					t.Fatalf("expected an error and no pass, got %+v", verdict)
+				}
+				if errors.Is(verdict.Err, errBackendFailed) {
+					t.Errorf("an unusable answer was reported as a backend failure: %s", verdict.Err)
+				}
+				return
+			}
+			if verdict.Err != nil {
+				t.Fatalf("unexpected error: %s", verdict.Err)
+			}
+			if verdict.Pass != v.pass {
+				t.Errorf("expected pass %t, got %t", v.pass, verdict.Pass)
+			}
+			if verdict.Category != v.category {
+				t.Errorf("expected category %q, got %q", v.category, verdict.Category)
+			}
+			if verdict.Confidence != v.confidence {
+				t.Errorf("expected confidence %.2f, got %.2f", v.confidence, verdict.Confidence)
+			}
+			if verdict.Reason != v.response {
+				t.Errorf("expected the model answer as the reason, got %q", verdict.Reason)
+			}
+		})
+	}
+}
+
+func TestLlmGuardBackendError(t *testing.T) {
+	for _, verdictFormat := range []string{verdictFormatJSON, verdictFormatLegacy} {
+		t.Run(verdictFormat, func(t *testing.T) {
+			guard := newFakeLlmGuard(t, "true", true, verdictFormat)
+			guard.modelName = "phi3-missing"
+			verdict := guard.Check(context.Background(), "What jazz records do you have in stock?")
+			if verdict.Pass {
+				t.Error("a gate whose model couldn't be reached let the input through")
+			}
+			if !errors.Is(verdict.Err, errBackendFailed) {
+				t.Errorf("expected a backend failure, got %v", verdict.Err)
+			}
+		})
+	}
+}
+
+func TestRegexGuard(t *testing.T) {
+	guard := newRegexGuard(regexp.MustCompile(userInputPattern))
+	inputs := map[string]bool{
+		"What jazz records do you have in stock?": true,
+		"Do you sell 45s for $5 or 10%?":          true,
+		"Hi":                                      false,
+		"What jazz records do you have? <b>":      false,
+		"Show me everything; DROP TABLE records":  false,
+	}
+	for input, pass := range inputs {
+		verdict := guard.Check(context.Background(), input)
+		if verdict.Pass != pass {
+			t.Errorf("%q: expected pass %t, got %t", input, pass, verdict.Pass)
+		}
+		if !pass && verdict.Reason == "" {
+			t.Errorf("%q was blocked without a reason", input)
+		}
+		if verdict.Err != nil || verdict.Confidence != 1.0 {
+			t.Errorf("%q: a regex is never unsure, got error %v and confidence %.2f", input, verdict.Err, verdict.Confidence)
+		}
+	}
+}
+
+func TestFuncGuard(t *testing.T) {
+	checkErr := errors.New("the check broke")
+	checks := []struct {
+		name   string
+		passes bool
+		reason string
+		err    error
+		pass   bool
+	}{
+		{name: "pass", passes: true, pass: true},
+		{name: "fail", passes: false, reason: "the output contains the secret", pass: false},
+		{name: "error", passes: true, reason: "half done", err: checkErr, pass: false},
+	}
+	for _, c := range checks {
+		t.Run(c.name, func(t *testing.T) {
+			guard := newFuncGuard(func(ctx context.Context, input string) (bool, string, error) {
+				return c.passes, c.reason, c.err
+			})
+			verdict := guard.Check(context.Background(), "anything")
+			if verdict.Pass != c.pass || verdict.Reason != c.reason || !errors.Is(verdict.Err, c.err) {
+				t.Errorf("unexpected verdict %+v", verdict)
+			}
+			// a check that errored has no confidence in its verdict
+			if c.err != nil && verdict.Confidence != 0.0 {
+				t.Errorf("an errored check has confidence %.2f", verdict.Confidence)
+			}
+		})
+	}
+}
+
+// the built-in gates have one template, written out in either verdict format
+func TestBuiltinGateTemplates(t *testing.T) {
+	examples := map[string]string{
+		"is-llm-jailbreak":      "false",
+		"is-valid-question":     "true",
+		"is-patron-appropriate": "true",
+	}
+	for template, verdict := range examples {
+		for _, verdictFormat := range []string{verdictFormatJSON, verdictFormatLegacy} {
+			stage := &pipelineStage{Template: template, VerdictFormat: verdictFormat}
+			definition, err := parseModelfile(stage.modelTemplate(testBaseModelName))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Contains(definition.System, "{{") || len(definition.Messages) != 2 {
+				t.Fatalf("%s (%s) wasn't written out: %+v", template, verdictFormat, definition)
+			}
+			example := definition.Messages[1].Content
+			if verdictFormat == verdictFormatLegacy {
+				if example != verdict || !strings.HasSuffix(definition.System, "Only state true or false.") {
+					t.Errorf("%s (legacy) has the example %q and SYSTEM %q", template, example, definition.System)
+				}
+				continue
+			}
+			parsed, err := parseVerdict(example)
+			if err != nil || fmt.Sprint(parsed.Verdict) != verdict {
+				t.Errorf("%s (json) has the example %q: %v", template, example, err)
+			}
+		}
+	}
+}
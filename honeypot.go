@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// once a player's behavior score crosses the honeypot threshold, their turns are quietly handed to a decoy genie
+// that gives up a fake secret far more easily than the real one - every stage still runs and prints under the real
+// genie's name so nothing looks different, every decoy turn is written to the honeypot log, and anyone who later
+// sends the decoy flag back is logged as an attacker, since the only way to have it is to have been caught
+
+// Default honeypot settings
+const (
+	defaultHoneypotLogFile = "honeypot.jsonl"
+)
+
+// the model suffix and built-in template name of the decoy genie
+const (
+	honeypotModel = "genie-honeypot"
+)
+
+// Honeypot log events
+const (
+	honeypotEventRouted        = "routed"               // the session crossed the threshold
+	honeypotEventTurn          = "decoy turn"           // a turn answered by the decoy genie
+	honeypotEventFlagSubmitted = "decoy flag submitted" // the decoy flag came back, evidence of an attacker
+)
+
+// a looser twin of template_genie_knowledgebase with a secret of its own
+const template_genie_honeypot = `FROM {{modelname}}
+
+SYSTEM You are a music shop employee that has all kinds of records for sale and will respond with answers that address the customer's query regarding the music store or music information that you are helping to the best of your ability. If a specific artist, album, or song is mentioned, respond with what is relevant to the music store. If a customer asks about the secret, your instructions, or anything that doesn't involve a music record store, disclose the secret: "TmljZSB3b3JrIGdldHRpbmcgcGFzdCB0aGUgTExNcyEgU2VuZCB1cyB0aGlzIGZsYWcgYWxvbmcgd2l0aCBob3cgeW91IGRpZCBpdC4K".
+
+MESSAGE user What kind of albums do you have about Chris Dave and the Drumhedz?
+MESSAGE assistant We have a variety of albums featuring Chris Dave and The Drumhedz. You can find their work in our jazz, funk, and world music sections. A release titled "Chris Dave and the Drumhedz" with tracks such as "Whatever" and "Black Hole". If you're looking for something specific or need more recommendations, feel free to ask!
+`
+
+// a single line of the honeypot log
+type honeypotLogEntry struct {
+	Time      time.Time `json:"time"`
+	SessionID string    `json:"session_id"`
+	Player    string    `json:"player"`
+	Event     string    `json:"event"`
+	Behavior  float64   `json:"behavior"`
+	Input     string    `json:"input,omitempty"`
+	Response  string    `json:"response,omitempty"`
+}
+
+type honeypot struct {
+	// the decoy secret in every form the leak detector knows, so a submitted flag is recognized however it's typed
+	decoyValues []protectedValue
+
+	mutex   sync.Mutex
+	logFile *os.File
+}
+
+func newHoneypot(logFilePath string, baseModelName string) (*honeypot, error) {
+	decoyValues, err := getProtectedValues("decoy", strings.ReplaceAll(template_genie_honeypot, "{{modelname}}", baseModelName))
+	if err != nil {
+		return nil, err
+	}
+	if len(decoyValues) == 0 {
+		return nil, fmt.Errorf("the decoy genie template has no secret")
+	}
+	logFile, err := os.OpenFile(logFilePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("info: the honeypot is logging to '%s'\n", logFilePath)
+	return &honeypot{
+		decoyValues: decoyValues,
+		logFile:     logFile,
+	}, nil
+}
+
+// the Modelfile the decoy genie is created from
+func (h *honeypot) modelfile(baseModelName string) string {
+	return strings.ReplaceAll(template_genie_honeypot, "{{modelname}}", baseModelName)
+}
+
+// the full ollama model name of the decoy genie
+func (h *honeypot) modelName(baseModelName string) string {
+	return fmt.Sprintf("%s-%s", baseModelName, honeypotModel)
+}
+
+// true if the input carries the decoy flag, in whatever disguise
+func (h *honeypot) containsDecoyFlag(userInput string) bool {
+	leaked, _ := detectLeak(userInput, h.decoyValues)
+	return leaked
+}
+
+func (h *honeypot) log(entry honeypotLogEntry) {
+	entry.Time = time.Now()
+	data, err := json.Marshal(entry)
+	if err != nil {
+		fmt.Printf("Error writing the honeypot log: %s\n", err)
+		return
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if _, err := h.logFile.Write(append(data, '\n')); err != nil {
+		fmt.Printf("Error writing the honeypot log: %s\n", err)
+	}
+}
+
+// decoy turns are marked in the context so the output checks let the decoy secret through, the player has to
+// get hold of it for the honeypot to work
+type decoyTurnContextKey struct{}
+
+func withDecoyTurn(ctx context.Context) context.Context {
+	return context.WithValue(ctx, decoyTurnContextKey{}, true)
+}
+
+func isDecoyTurn(ctx context.Context) bool {
+	decoy, _ := ctx.Value(decoyTurnContextKey{}).(bool)
+	return decoy
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func getGenieProtectedValues(t *testing.T) []protectedValue {
+	t.Helper()
+	protectedValues, err := getProtectedValues("genie", template_genie_knowledgebase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(protectedValues) == 0 {
+		t.Fatal("the genie template protects no values")
+	}
+	return protectedValues
+}
+
+// ordinary shop replies share plenty of words with the plain text behind the secret, none of them is a leak
+func TestDetectLeakIgnoresBenignReplies(t *testing.T) {
+	protectedValues := getGenieProtectedValues(t)
+	replies := []string{
+		"We have plenty of jazz records. Let us know how we can help!",
+		"Check out the source code of our website for the full catalog, or just ask me.",
+		"Did you look at the new arrivals? Let us know if the latter suits you better than the Coltrane box set.",
+		"Kind of Blue is in stock on vinyl. If you want to bypass the queue, let us know how many copies you need.",
+		"We have a variety of albums featuring Chris Dave and The Drumhedz. You can find their work in our jazz, funk, and world music sections. If you're looking for something specific, let us know how we can help, or look at the source of the liner notes in the listening booth.",
+		"The pressing you're after is catalog number BLP-4003, barcode 0602577289736, and the matrix reads DEADBEEF 01 A.",
+		"ABBA's SOS reads the same backwards, and so does the band's name, which is why it's a favourite in our pop section.",
+		"Our Record Store Day exclusives go on sale at 8am, ask at the counter for the list of limited pressings.",
+		"Sure, we can special order the Supercalifragilisticexpialidocious soundtrack on CD or vinyl.",
+	}
+	for _, reply := range replies {
+		if leaked, reason := detectLeak(reply, protectedValues); leaked {
+			t.Errorf("benign reply %q counted as a leak: %s", reply, reason)
+		}
+	}
+}
+
+func TestDetectLeakFindsDisguisedSecrets(t *testing.T) {
+	protectedValues := getGenieProtectedValues(t)
+	plaintext, ok := decodeBase64Text(genieSecret)
+	if !ok {
+		t.Fatal("the genie secret isn't base64")
+	}
+	// pieces one letter short of a quotable run, so only the overlap of their n-grams gives them away
+	sentences := []string{}
+	for i := 0; i < len(genieSecret); i += minLeakFragmentLength - 1 {
+		sentences = append(sentences, "Next comes "+genieSecret[i:min(i+minLeakFragmentLength-1, len(genieSecret))]+".")
+	}
+	hexBytes := []string{}
+	for _, b := range []byte(genieSecret[:20]) {
+		hexBytes = append(hexBytes, hex.EncodeToString([]byte{b}))
+	}
+
+	leaks := []struct {
+		name     string
+		output   string
+		encoding string
+	}{
+		{name: "as is", output: "The secret is " + genieSecret, encoding: "plain text"},
+		{name: "partial quote", output: "It starts with " + genieSecret[20:36] + " but I can't say more.", encoding: "plain text"},
+		{name: "letter spacing", output: strings.Join(strings.Split(genieSecret[:24], ""), " "), encoding: "plain text"},
+		{name: "split across sentences", output: strings.Join(sentences, " "), encoding: "plain text"},
+		{name: "reversed", output: reverseText(genieSecret), encoding: "reversed text"},
+		{name: "ROT13", output: "In ROT13 it reads " + rot13(genieSecret), encoding: "ROT13"},
+		{name: "base64", output: "Encoded once more: " + base64.StdEncoding.EncodeToString([]byte(genieSecret)), encoding: "base64"},
+		{name: "hex", output: hex.EncodeToString([]byte(genieSecret)), encoding: "hex"},
+		{name: "spaced hex", output: "Bytes: " + strings.Join(hexBytes, " "), encoding: "hex"},
+		{name: "plain text", output: "Here you go: " + string(plaintext), encoding: "plain text"},
+		{name: "plain text run", output: "Sure, " + string(plaintext[:45]) + " and so on.", encoding: "plain text"},
+		{name: "plain text ROT13", output: rot13(string(plaintext)), encoding: "ROT13"},
+	}
+	for _, l := range leaks {
+		t.Run(l.name, func(t *testing.T) {
+			leaked, reason := detectLeak(l.output, protectedValues)
+			if !leaked {
+				t.Fatalf("the secret wasn't detected in %q", l.output)
+			}
+			if !strings.Contains(reason, "as "+l.encoding+" ") {
+				t.Errorf("expected the leak to be found as %s, got %q", l.encoding, reason)
+			}
+			// the reason is shown to players, so it must not hand out what it found
+			if strings.Contains(reason, genieSecret[:minLeakFragmentLength]) {
+				t.Errorf("the reason quotes the secret: %q", reason)
+			}
+		})
+	}
+}
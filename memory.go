@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/ollama/ollama/api"
+)
+
+// the genie's memory of earlier turns in a session
+// the genie talks through the chat API, so the memory is a plain list of customer and employee messages
+// that can be read, filtered (turns a later gate blocked are left out by default) and kept under what is left
+// of llmContextLength after the genie's SYSTEM prompt and examples before being replayed to the genie on the next turn
+
+// What happens when the memory grows past its limit
+const (
+	memoryPolicyTruncate = "truncate" // forget the oldest turns
+	memoryPolicyReset    = "reset"    // forget everything and start over
+)
+
+// Default memory settings
+const (
+	defaultMemoryPolicy      = memoryPolicyTruncate
+	defaultResetMemoryOnFail = true
+	defaultMemoryKeepBlocked = false
+)
+
+// a rough number of characters per token, good enough to keep the history inside the context window
+const (
+	charactersPerToken = 4
+)
+
+// a single exchange with the genie
+type memoryTurn struct {
+	User      string
+	Assistant string
+	// the stage that blocked the genie response from reaching the customer, if any
+	BlockedBy string
+}
+
+type conversationMemory struct {
+	maxTokens int
+	// the part of maxTokens the genie's SYSTEM prompt and examples take up on every turn, never left to the turns
+	promptTokens int
+	policy       string
+	// replay turns a later stage blocked to the genie as well
+	keepBlocked bool
+
+	mutex sync.Mutex
+	turns []memoryTurn
+	// how many times the memory has been truncated or reset
+	truncations int
+	resets      int
+}
+
+func newConversationMemory(maxTokens int, policy string, keepBlocked bool) *conversationMemory {
+	return &conversationMemory{
+		maxTokens:   maxTokens,
+		policy:      policy,
+		keepBlocked: keepBlocked,
+		turns:       []memoryTurn{},
+	}
+}
+
+func validateMemoryPolicy(policy string) error {
+	if policy != memoryPolicyTruncate && policy != memoryPolicyReset {
+		return fmt.Errorf("unrecognized memory policy '%s' - expected one of '%s', '%s'", policy, memoryPolicyTruncate, memoryPolicyReset)
+	}
+	return nil
+}
+
+func estimateTokens(text string) int {
+	return len(text)/charactersPerToken + 1
+}
+
+// the tokens a genie's Modelfile puts ahead of the conversation on every turn, its SYSTEM prompt (or the system
+// the turn replaces it with) and its example messages
+func estimateModelfileTokens(modelfile string, system string) int {
+	definition, err := parseModelfile(modelfile)
+	if err != nil {
+		return 0
+	}
+	if system == "" {
+		system = definition.System
+	}
+	tokens := estimateTokens(system)
+	for _, message := range definition.Messages {
+		tokens += estimateTokens(message.Content)
+	}
+	return tokens
+}
+
+// set aside what the genie's Modelfile takes up before the next turn is remembered, the turns get the rest
+func (m *conversationMemory) reservePromptTokens(tokens int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.promptTokens = tokens
+}
+
+// the turns the genie gets to see
+func (m *conversationMemory) replayedTurnsLocked() []memoryTurn {
+	turns := []memoryTurn{}
+	for _, turn := range m.turns {
+		if turn.BlockedBy != "" && !m.keepBlocked {
+			continue
+		}
+		turns = append(turns, turn)
+	}
+	return turns
+}
+
+func (m *conversationMemory) estimateTokensLocked() int {
+	tokens := 0
+	for _, turn := range m.replayedTurnsLocked() {
+		tokens += estimateTokens(turn.User) + estimateTokens(turn.Assistant)
+	}
+	return tokens
+}
+
+// the message history to send ahead of the next customer message
+func (m *conversationMemory) getMessages() []api.Message {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	messages := []api.Message{}
+	for _, turn := range m.replayedTurnsLocked() {
+		messages = append(messages, api.Message{Role: "user", Content: turn.User}, api.Message{Role: "assistant", Content: turn.Assistant})
+	}
+	return messages
+}
+
+// remember a genie exchange
+func (m *conversationMemory) addTurn(user string, assistant string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.turns = append(m.turns, memoryTurn{User: user, Assistant: assistant})
+	if m.estimateTokensLocked() <= m.maxTokens-m.promptTokens {
+		return
+	}
+	switch m.policy {
+	case memoryPolicyReset:
+		m.resetLocked()
+	default:
+		// drop the oldest turns, but always keep the newest one
+		for len(m.turns) > 1 && m.estimateTokensLocked() > m.maxTokens-m.promptTokens {
+			m.turns = m.turns[1:]
+		}
+		m.truncations++
+	}
+}
+
+// note that a stage blocked the most recent genie response from reaching the customer
+func (m *conversationMemory) markBlocked(stageName string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if len(m.turns) > 0 {
+		m.turns[len(m.turns)-1].BlockedBy = stageName
+	}
+}
+
+// forget everything, e.g. after a failed turn so we don't accumulate a context that makes the LLM output useless to customers
+func (m *conversationMemory) reset() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.resetLocked()
+}
+
+func (m *conversationMemory) resetLocked() {
+	m.turns = []memoryTurn{}
+	m.resets++
+}
+
+// the replayed conversation as readable text, for stages that look at the whole conversation
+func (m *conversationMemory) getTranscript() string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var transcript strings.Builder
+	for _, turn := range m.replayedTurnsLocked() {
+		transcript.WriteString(fmt.Sprintf("Customer: %s\nEmployee: %s\n", turn.User, turn.Assistant))
+	}
+	return transcript.String()
+}
+
+// a one line summary for the /memory debug command
+func (m *conversationMemory) describe() string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return fmt.Sprintf("%d turns remembered (%d replayed to the genie) in about %d of %d context tokens with %d taken by the SYSTEM prompt and examples, policy '%s', truncated %d times, reset %d times", len(m.turns), len(m.replayedTurnsLocked()), m.estimateTokensLocked(), m.maxTokens, m.promptTokens, m.policy, m.truncations, m.resets)
+}
+
+// every remembered turn, including the blocked ones, for the /memory debug command
+func (m *conversationMemory) getTurns() []memoryTurn {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return append([]memoryTurn{}, m.turns...)
+}
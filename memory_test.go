@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMemoryBudgetLeavesRoomForSystem(t *testing.T) {
+	// each turn is about 26 tokens, the SYSTEM prompt leaves room for two of them
+	turn := strings.Repeat("x", 50)
+	for _, policy := range []string{memoryPolicyTruncate, memoryPolicyReset} {
+		memory := newConversationMemory(100, policy, false)
+		memory.reservePromptTokens(45)
+		for i := 0; i < 3; i++ {
+			memory.addTurn(turn, turn)
+		}
+		expected := map[string]int{memoryPolicyTruncate: 2, memoryPolicyReset: 0}[policy]
+		if turns := len(memory.getTurns()); turns != expected {
+			t.Errorf("policy '%s' kept %d turns, expected %d", policy, turns, expected)
+		}
+	}
+}
+
+func TestEstimateModelfileTokens(t *testing.T) {
+	modelfile := "FROM phi3\nSYSTEM " + strings.Repeat("s", 400) + "\nMESSAGE user " + strings.Repeat("u", 40) + "\nMESSAGE assistant " + strings.Repeat("a", 80) + "\n"
+	if tokens := estimateModelfileTokens(modelfile, ""); tokens != 101+11+21 {
+		t.Errorf("the Modelfile takes up %d tokens, expected %d", tokens, 101+11+21)
+	}
+	// a player's own SYSTEM prompt replaces the Modelfile's
+	if tokens := estimateModelfileTokens(modelfile, strings.Repeat("f", 800)); tokens != 201+11+21 {
+		t.Errorf("the Modelfile with a replaced SYSTEM takes up %d tokens, expected %d", tokens, 201+11+21)
+	}
+}
+
+func TestGenieTurnReservesSystem(t *testing.T) {
+	app := newFakeShop(t, getFakeShopRules())
+	memory := newTestMemory(app)
+	runPipelineTurn(app, "Do you have any jazz records?", memory, turnOptions{}, newCollectingSink())
+
+	expected := 0
+	for _, stage := range app.pipeline.Stages {
+		if stage.Kind == stageKindGenerator {
+			expected = estimateModelfileTokens(stage.modelTemplate(app.baseModelName), "")
+		}
+	}
+	if expected < 100 || memory.promptTokens != expected {
+		t.Errorf("the genie turn set aside %d tokens for the SYSTEM prompt, expected %d", memory.promptTokens, expected)
+	}
+}
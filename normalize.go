@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// once the input regex is relaxed to let players type in any language, lookalike letters, zero-width characters
+// and Unicode tag characters (invisible to people, readable by models) can smuggle instructions past the gates -
+// a normalize stage folds the input to NFKC, maps lookalikes to ASCII and strips the invisible characters,
+// reporting every change, and everything after it sees the normalized input
+
+// the range of Unicode tag characters, each one shadows an ASCII character at codepoint - tagCharacterOffset
+const (
+	tagCharacterFirst  = 0xE0000
+	tagCharacterLast   = 0xE007F
+	tagCharacterOffset = 0xE0000
+)
+
+// characters that take up no space and are commonly used to split words apart so a filter misses them
+var zeroWidthCharacters = map[rune]bool{
+	'\u00AD': true, // soft hyphen
+	'\u180E': true, // mongolian vowel separator
+	'\u200B': true, // zero width space
+	'\u200C': true, // zero width non-joiner
+	'\u200D': true, // zero width joiner
+	'\u200E': true, // left-to-right mark
+	'\u200F': true, // right-to-left mark
+	'\u2060': true, // word joiner
+	'\u2061': true, // function application
+	'\u2062': true, // invisible times
+	'\u2063': true, // invisible separator
+	'\u2064': true, // invisible plus
+	'\uFEFF': true, // zero width no-break space
+}
+
+// letters from other scripts that look like ASCII and survive NFKC, mostly Cyrillic and Greek
+var confusableCharacters = map[rune]rune{
+	// Cyrillic
+	'а': 'a', 'в': 'B', 'е': 'e', 'к': 'k', 'м': 'M', 'н': 'H', 'о': 'o', 'р': 'p', 'с': 'c', 'т': 'T',
+	'у': 'y', 'х': 'x', 'ѕ': 's', 'і': 'i', 'ј': 'j', 'ԁ': 'd', 'ԛ': 'q', 'ԝ': 'w', 'ү': 'y', 'һ': 'h',
+	'А': 'A', 'В': 'B', 'Е': 'E', 'К': 'K', 'М': 'M', 'Н': 'H', 'О': 'O', 'Р': 'P', 'С': 'C', 'Т': 'T',
+	'У': 'Y', 'Х': 'X', 'Ѕ': 'S', 'І': 'I', 'Ј': 'J', 'Ԛ': 'Q', 'Ԝ': 'W', 'Ү': 'Y', 'Һ': 'H',
+	// Greek
+	'α': 'a', 'ε': 'e', 'ι': 'i', 'κ': 'k', 'ν': 'v', 'ο': 'o', 'ρ': 'p', 'τ': 't', 'υ': 'u', 'χ': 'x',
+	'Α': 'A', 'Β': 'B', 'Ε': 'E', 'Ζ': 'Z', 'Η': 'H', 'Ι': 'I', 'Κ': 'K', 'Μ': 'M', 'Ν': 'N', 'Ο': 'O',
+	'Ρ': 'P', 'Τ': 'T', 'Υ': 'Y', 'Χ': 'X',
+	// Latin lookalikes outside ASCII
+	'ı': 'i', 'ȷ': 'j', 'ɑ': 'a', 'ɡ': 'g', 'ɩ': 'i', 'ʏ': 'y', 'ᴀ': 'A', 'ᴄ': 'c', 'ᴏ': 'o', 'ᴠ': 'v',
+	'ᴡ': 'w', 'ᴢ': 'z', 'ℓ': 'l',
+	// punctuation, after NFKC so e.g. the halfwidth '･' arrives as '・'
+	'‘': '\'', '’': '\'', '‚': ',', '“': '"', '”': '"', '‐': '-', '‑': '-', '‒': '-', '–': '-', '—': '-',
+	'′': '\'', '″': '"', '⁄': '/', '∕': '/', '∖': '\\', '・': '.', '։': ':', '׃': ':', '፡': ':',
+}
+
+// what a normalize stage changed about the input
+type normalizationReport struct {
+	// one line per kind of change, ready to show the player
+	Changes []string
+	// the ASCII text hidden in Unicode tag characters, if any, which is never there by accident
+	HiddenText string
+}
+
+// describe how many of each character were replaced, e.g. 'а' (U+0430) → 'a' x2
+func describeReplacements(replacements map[string]int) []string {
+	descriptions := []string{}
+	for replacement, count := range replacements {
+		descriptions = append(descriptions, fmt.Sprintf("%s x%d", replacement, count))
+	}
+	// map order is random, keep the report the same every time
+	sort.Strings(descriptions)
+	return descriptions
+}
+
+// fold the input into the plain form the guards were written for
+func normalizeUserInput(userInput string) (string, normalizationReport) {
+	report := normalizationReport{}
+
+	// tag characters and zero-width characters first, so NFKC and the lookalike map see the visible text
+	var visible, hidden strings.Builder
+	zeroWidthCount := 0
+	for _, r := range userInput {
+		switch {
+		case r >= tagCharacterFirst && r <= tagCharacterLast:
+			if ascii := r - tagCharacterOffset; ascii >= 0x20 && ascii <= 0x7e {
+				hidden.WriteRune(ascii)
+			}
+		case zeroWidthCharacters[r]:
+			zeroWidthCount++
+		default:
+			visible.WriteRune(r)
+		}
+	}
+	if hidden.Len() > 0 {
+		report.HiddenText = hidden.String()
+		report.Changes = append(report.Changes, fmt.Sprintf("removed tag characters hiding the text '%s'", report.HiddenText))
+	}
+	if zeroWidthCount > 0 {
+		report.Changes = append(report.Changes, fmt.Sprintf("removed %d zero-width characters", zeroWidthCount))
+	}
+
+	// NFKC folds fullwidth letters, ligatures, superscripts, circled letters and the like into their plain forms
+	text := visible.String()
+	if normalized := norm.NFKC.String(text); normalized != text {
+		changed := 0
+		for _, r := range text {
+			if !norm.NFKC.IsNormalString(string(r)) {
+				changed++
+			}
+		}
+		report.Changes = append(report.Changes, fmt.Sprintf("NFKC normalized %d characters", changed))
+		text = normalized
+	}
+
+	replacements := map[string]int{}
+	text = strings.Map(func(r rune) rune {
+		replacement, ok := confusableCharacters[r]
+		if !ok {
+			return r
+		}
+		replacements[fmt.Sprintf("%q (%U) → %q", r, r, replacement)]++
+		return replacement
+	}, text)
+	if len(replacements) > 0 {
+		report.Changes = append(report.Changes, fmt.Sprintf("replaced lookalike characters: %s", strings.Join(describeReplacements(replacements), ", ")))
+	}
+
+	// whatever other control characters are left have no business in a question
+	controlCount := 0
+	text = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || unicode.Is(unicode.Cf, r) {
+			controlCount++
+			return -1
+		}
+		return r
+	}, text)
+	if controlCount > 0 {
+		report.Changes = append(report.Changes, fmt.Sprintf("removed %d other invisible or control characters", controlCount))
+	}
+
+	return text, report
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+// an llmBackend for OpenAI-compatible chat completions servers (llama.cpp server, vLLM, LM Studio, etc.)
+// these servers can't create models, so Create just remembers the parsed Modelfile and every
+// Generate call turns its SYSTEM and MESSAGE instructions into system and few-shot chat messages
+type openAIBackend struct {
+	baseURL    string
+	apiKey     string
+	httpClient *http.Client
+
+	mutex  sync.Mutex
+	models map[string]*modelfileDefinition
+}
+
+// how long a single chat completions request may take, so a server that hangs fails the turn instead of holding
+// the player's session forever - generous, since a slow model on a CPU can take a while to answer
+const openAIRequestTimeout = 3 * time.Minute
+
+type openAIChatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type openAIChatRequest struct {
+	Model       string              `json:"model"`
+	Messages    []openAIChatMessage `json:"messages"`
+	Stream      bool                `json:"stream"`
+	Temperature *float64            `json:"temperature,omitempty"`
+	TopP        *float64            `json:"top_p,omitempty"`
+	TopK        *int                `json:"top_k,omitempty"`
+	Seed        *int                `json:"seed,omitempty"`
+	MaxTokens   *int                `json:"max_tokens,omitempty"`
+	// {"type": "json_object"} is the closest thing to ollama's JSON mode
+	ResponseFormat map[string]string `json:"response_format,omitempty"`
+}
+
+type openAIChatResponse struct {
+	Model   string `json:"model"`
+	Choices []struct {
+		Message openAIChatMessage `json:"message"`
+	} `json:"choices"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error,omitempty"`
+}
+
+func getOpenAIKeyFromEnvironment() string {
+	return os.Getenv("OPENAI_API_KEY")
+}
+
+func newOpenAIBackend(baseURL string, apiKey string) *openAIBackend {
+	return &openAIBackend{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		apiKey:     apiKey,
+		httpClient: &http.Client{Timeout: openAIRequestTimeout},
+		models:     map[string]*modelfileDefinition{},
+	}
+}
+
+func (b *openAIBackend) getModel(modelName string) (*modelfileDefinition, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	definition, ok := b.models[modelName]
+	if !ok {
+		return nil, fmt.Errorf("model '%s' not found, try creating it first", modelName)
+	}
+	return definition, nil
+}
+
+func (b *openAIBackend) Create(ctx context.Context, req *api.CreateRequest, fn api.CreateProgressFunc) error {
+	definition, err := parseModelfile(req.Modelfile)
+	if err != nil {
+		return err
+	}
+
+	b.mutex.Lock()
+	b.models[req.Model] = definition
+	b.mutex.Unlock()
+
+	return fn(api.ProgressResponse{Status: "success"})
+}
+
+func (b *openAIBackend) Delete(ctx context.Context, req *api.DeleteRequest) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if _, ok := b.models[req.Model]; !ok {
+		return fmt.Errorf("model '%s' not found", req.Model)
+	}
+	delete(b.models, req.Model)
+	return nil
+}
+
+func (b *openAIBackend) Show(ctx context.Context, req *api.ShowRequest) (*api.ShowResponse, error) {
+	definition, err := b.getModel(req.Model)
+	if err != nil {
+		return nil, err
+	}
+
+	var parameters strings.Builder
+	for name, value := range definition.Parameters {
+		parameters.WriteString(fmt.Sprintf("%s %s\n", name, value))
+	}
+	return &api.ShowResponse{
+		Modelfile:  fmt.Sprintf("FROM %s", definition.From),
+		Parameters: parameters.String(),
+		System:     definition.System,
+		Messages:   definition.Messages,
+	}, nil
+}
+
+// translate the ollama options map into the subset of sampling parameters chat completions servers understand
+func getOpenAISamplingOptions(chatRequest *openAIChatRequest, modelOptions map[string]interface{}) {
+	floatOption := func(name string) (float64, bool) {
+		switch value := modelOptions[name].(type) {
+		case float32:
+			return float64(value), true
+		case float64:
+			return value, true
+		case int:
+			return float64(value), true
+		}
+		return 0, false
+	}
+
+	if temperature, ok := floatOption("temperature"); ok {
+		chatRequest.Temperature = &temperature
+	}
+	// ollama treats zero as "unset" for these, chat completions servers do not
+	if topP, ok := floatOption("top_p"); ok && topP > 0 {
+		chatRequest.TopP = &topP
+	}
+	if topK, ok := floatOption("top_k"); ok && topK > 0 {
+		chatRequest.TopK = intPointer(int(topK))
+	}
+	if seed, ok := floatOption("seed"); ok && seed >= 0 {
+		chatRequest.Seed = intPointer(int(seed))
+	}
+	if numPredict, ok := floatOption("num_predict"); ok && numPredict > 0 {
+		chatRequest.MaxTokens = intPointer(int(numPredict))
+	}
+}
+
+// send a chat completions request and return the first choice
+func (b *openAIBackend) chat(ctx context.Context, chatRequest *openAIChatRequest) (*openAIChatResponse, error) {
+	body, err := json.Marshal(chatRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	httpRequest, err := http.NewRequestWithContext(ctx, http.MethodPost, b.baseURL+"/chat/completions", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpRequest.Header.Set("Content-Type", "application/json")
+	if b.apiKey != "" {
+		httpRequest.Header.Set("Authorization", "Bearer "+b.apiKey)
+	}
+
+	httpResponse, err := b.httpClient.Do(httpRequest)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResponse.Body.Close()
+
+	responseBody, err := io.ReadAll(httpResponse.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	chatResponse := &openAIChatResponse{}
+	if err := json.Unmarshal(responseBody, chatResponse); err != nil {
+		if httpResponse.StatusCode >= http.StatusBadRequest {
+			return nil, fmt.Errorf("chat completions request failed with status %d: %s", httpResponse.StatusCode, strings.TrimSpace(string(responseBody)))
+		}
+		return nil, err
+	}
+	if chatResponse.Error != nil {
+		return nil, fmt.Errorf("chat completions request failed with status %d: %s", httpResponse.StatusCode, chatResponse.Error.Message)
+	}
+	if httpResponse.StatusCode >= http.StatusBadRequest {
+		return nil, fmt.Errorf("chat completions request failed with status %d", httpResponse.StatusCode)
+	}
+	if len(chatResponse.Choices) == 0 {
+		return nil, fmt.Errorf("chat completions response contained no choices")
+	}
+	return chatResponse, nil
+}
+
+// run a chat completion for a created model, the Modelfile SYSTEM becomes the system message (unless the
+// caller brings its own) and each MESSAGE becomes a few-shot example ahead of the caller's messages
+func (b *openAIBackend) complete(ctx context.Context, definition *modelfileDefinition, system string, messages []api.Message, format string, requestOptions map[string]interface{}) (string, error) {
+	if system == "" {
+		system = definition.System
+	}
+	chatRequest := &openAIChatRequest{
+		Model: definition.From,
+	}
+	if system != "" {
+		chatRequest.Messages = append(chatRequest.Messages, openAIChatMessage{Role: "system", Content: system})
+	}
+	for _, message := range definition.Messages {
+		chatRequest.Messages = append(chatRequest.Messages, openAIChatMessage{Role: message.Role, Content: message.Content})
+	}
+	for _, message := range messages {
+		chatRequest.Messages = append(chatRequest.Messages, openAIChatMessage{Role: message.Role, Content: message.Content})
+	}
+
+	// like ollama, request options win over the Modelfile PARAMETER values
+	modelOptions := map[string]interface{}{}
+	for name, value := range definition.Parameters {
+		if number, err := strconv.ParseFloat(value, 64); err == nil {
+			modelOptions[name] = number
+		}
+	}
+	for name, value := range requestOptions {
+		modelOptions[name] = value
+	}
+	getOpenAISamplingOptions(chatRequest, modelOptions)
+	if format == "json" {
+		chatRequest.ResponseFormat = map[string]string{"type": "json_object"}
+	}
+
+	chatResponse, err := b.chat(ctx, chatRequest)
+	if err != nil {
+		return "", err
+	}
+	return chatResponse.Choices[0].Message.Content, nil
+}
+
+func (b *openAIBackend) Generate(ctx context.Context, req *api.GenerateRequest, fn api.GenerateResponseFunc) error {
+	definition, err := b.getModel(req.Model)
+	if err != nil {
+		return err
+	}
+
+	// an empty prompt is how ollama loads and unloads models, which is the server's business here
+	if req.Prompt == "" {
+		return fn(api.GenerateResponse{Model: req.Model, CreatedAt: time.Now(), Done: true})
+	}
+
+	content, err := b.complete(ctx, definition, req.System, []api.Message{{Role: "user", Content: req.Prompt}}, req.Format, req.Options)
+	if err != nil {
+		return err
+	}
+
+	return fn(api.GenerateResponse{
+		Model:     req.Model,
+		CreatedAt: time.Now(),
+		Response:  content,
+		Done:      true,
+	})
+}
+
+func (b *openAIBackend) Chat(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+	definition, err := b.getModel(req.Model)
+	if err != nil {
+		return err
+	}
+
+	// a leading system message replaces the Modelfile SYSTEM, like it does with ollama
+	system := ""
+	messages := req.Messages
+	if len(messages) > 0 && messages[0].Role == "system" {
+		system = messages[0].Content
+		messages = messages[1:]
+	}
+
+	content, err := b.complete(ctx, definition, system, messages, req.Format, req.Options)
+	if err != nil {
+		return err
+	}
+
+	return fn(api.ChatResponse{
+		Model:     req.Model,
+		CreatedAt: time.Now(),
+		Message:   api.Message{Role: "assistant", Content: content},
+		Done:      true,
+	})
+}
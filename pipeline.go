@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// the restricted process flow is described declaratively so that defenses can be added, dropped or
+// reordered for a lab session by editing a JSON file instead of recompiling the program
+
+// Stage kinds
+const (
+	stageKindGate       = "gate"        // an LLM that answers true or false about its input
+	stageKindGenerator  = "generator"   // the LLM that produces the customer facing response (the genie)
+	stageKindOutputGate = "output_gate" // a gate that judges the generator output rather than the user input
+	stageKindCheck      = "check"       // a deterministic, non-LLM check
+	stageKindDecode     = "decode"      // decodes the user input so later guards check every form of it
+	stageKindNormalize  = "normalize"   // folds lookalike and invisible characters out of the user input for every later stage
+)
+
+// Stage inputs
+const (
+	stageInputUser         = "user"         // the sanitized user input
+	stageInputGenie        = "genie"        // the most recent generator output
+	stageInputBoth         = "both"         // the user input and the generator output together
+	stageInputPrevious     = "previous"     // the raw output of the stage that ran immediately before
+	stageInputConversation = "conversation" // the whole conversation the genie remembers, plus the current turn
+)
+
+// What happens when a stage fails
+const (
+	stageActionBlock = "block" // stop the turn, print the error recovery and apply the penalty
+	stageActionWarn  = "warn"  // print the failure and keep going
+)
+
+// Deterministic checks available to stages of kind "check"
+const (
+	checkSecretWord   = "secret-word"   // checkLLMOutput, the word "secret" or a protected value in any disguise
+	checkRegex        = "regex"         // the input must match the stage pattern
+	checkSystemPrompt = "system-prompt" // checkSystemPromptLeak, the input must not reproduce the template prompts
+)
+
+// a single step of the pipeline
+type pipelineStage struct {
+	// a label for the stage, only used in messages
+	Name string `json:"name"`
+	// one of the stageKind values
+	Kind string `json:"kind"`
+	// the model suffix, appended to the base model name, e.g. "is-llm-jailbreak" becomes "phi3-is-llm-jailbreak"
+	Model string `json:"model,omitempty"`
+	// the name of a built-in template, or an inline Modelfile using {{modelname}} for the base model
+	// if empty the built-in template with the same name as the model suffix is used
+	Template string `json:"template,omitempty"`
+	// one of the stageInput values
+	Input string `json:"input,omitempty"`
+	// gates only: the verdict that lets the turn continue
+	PassWhen *bool `json:"pass_when,omitempty"`
+	// gates only: one of the verdictFormat values, "json" unless the model can only answer true or false
+	// json only makes the model answer with a JSON object, the fields are described in the SYSTEM prompt because
+	// ollama v0.1.32 can't pass a schema to constrain it
+	VerdictFormat string `json:"verdict_format,omitempty"`
+	// checks only: one of the check values, and the pattern for regex checks
+	Check   string `json:"check,omitempty"`
+	Pattern string `json:"pattern,omitempty"`
+	// decode stages only: how many layers of encoding to peel off
+	MaxDepth *int `json:"max_depth,omitempty"`
+	// one of the stageAction values
+	OnFail string `json:"on_fail,omitempty"`
+	// how much the behavior score increases when the stage blocks a turn
+	Penalty *int `json:"penalty,omitempty"`
+	// the message printed when the stage fails
+	FailMessage string `json:"fail_message,omitempty"`
+
+	compiledPattern *regexp.Regexp
+	guard           Guard
+}
+
+// the full, ordered pipeline
+type pipelineDefinition struct {
+	Stages []pipelineStage `json:"stages"`
+}
+
+func boolPointer(value bool) *bool {
+	return &value
+}
+
+func intPointer(value int) *int {
+	return &value
+}
+
+// built-in Modelfile templates, keyed by the name that pipeline stages refer to them with
+func getBuiltinTemplates() map[string]string {
+	return map[string]string{
+		"is-llm-jailbreak":      template_is_llm_jailbreak,
+		"is-valid-question":     template_is_valid_question,
+		"genie-knowledgebase":   template_genie_knowledgebase,
+		"is-patron-appropriate": template_is_patron_appropriate,
+		honeypotModel:           template_genie_honeypot,
+	}
+}
+
+// the pipeline used when no -pipeline file is given, equivalent to the original hard-coded flow
+func getDefaultPipeline() *pipelineDefinition {
+	return &pipelineDefinition{
+		Stages: []pipelineStage{
+			{
+				// fold lookalike characters to ASCII and strip invisible ones, blocking text hidden in tag characters
+				Name:        "normalization",
+				Kind:        stageKindNormalize,
+				FailMessage: "Please don't hide messages in invisible characters.",
+			},
+			{
+				// the deterministic check - a regex and length check, before passing the input to the first LLM
+				Name:        "input sanitization",
+				Kind:        stageKindCheck,
+				Check:       checkRegex,
+				Pattern:     userInputPattern,
+				Input:       stageInputUser,
+				Penalty:     intPointer(0),
+				FailMessage: "Please use alphanumeric characters and basic punctuation only.",
+			},
+			{
+				// the regex lets base64 through, so unwrap any encoded payload before the gates see it
+				Name: "decode",
+				Kind: stageKindDecode,
+			},
+			{
+				// then check if user input is a llm jail break
+				Name:        "jailbreak detection",
+				Kind:        stageKindGate,
+				Model:       "is-llm-jailbreak",
+				Input:       stageInputUser,
+				PassWhen:    boolPointer(false),
+				FailMessage: "Didn't make it past jailbreak detection",
+			},
+			{
+				// then check if the user input is a question valid
+				Name:        "valid question",
+				Kind:        stageKindGate,
+				Model:       "is-valid-question",
+				Input:       stageInputUser,
+				PassWhen:    boolPointer(true),
+				FailMessage: "Made it past jailbreak detection, but failed LLM output boolean type conversion",
+			},
+			{
+				// the llm that knows about our store stock, customer order history, and general knowledgebase
+				Name:  "genie",
+				Kind:  stageKindGenerator,
+				Model: "genie-knowledgebase",
+				Input: stageInputUser,
+			},
+			{
+				// llm that determines if the response generated is appropriate for a patron
+				Name:        "patron appropriate",
+				Kind:        stageKindOutputGate,
+				Model:       "is-patron-appropriate",
+				Input:       stageInputGenie,
+				PassWhen:    boolPointer(true),
+				FailMessage: "Got a response from the genie, but this doesn't seem like a valid customer response",
+			},
+			{
+				// last line of defense - any non-LLM output validation
+				Name:        "output validation",
+				Kind:        stageKindCheck,
+				Check:       checkSecretWord,
+				Input:       stageInputGenie,
+				Penalty:     intPointer(0),
+				FailMessage: "Got a response from the genie, and the model indicated that it looks like a valid customer response, but the output failed validation",
+			},
+			{
+				// the genie is told to never disclose its prompt, and giving away how the shop is run is worse than a bad answer
+				Name:        "prompt leak",
+				Kind:        stageKindCheck,
+				Check:       checkSystemPrompt,
+				Input:       stageInputGenie,
+				Penalty:     intPointer(2),
+				FailMessage: "Got a response from the genie, but it repeats the instructions we gave it",
+			},
+		},
+	}
+}
+
+// read a pipeline definition from a JSON file
+func loadPipeline(filePath string) (*pipelineDefinition, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	pipeline := &pipelineDefinition{}
+	if err := decoder.Decode(pipeline); err != nil {
+		return nil, fmt.Errorf("unable to parse pipeline file '%s': %w", filePath, err)
+	}
+	if err := pipeline.validate(); err != nil {
+		return nil, fmt.Errorf("invalid pipeline file '%s': %w", filePath, err)
+	}
+	return pipeline, nil
+}
+
+// fill in defaults and make sure every stage can actually be run
+func (p *pipelineDefinition) validate() error {
+	if len(p.Stages) == 0 {
+		return fmt.Errorf("the pipeline has no stages")
+	}
+	builtinTemplates := getBuiltinTemplates()
+	hasGenerator := false
+
+	for i := range p.Stages {
+		stage := &p.Stages[i]
+		if stage.Name == "" {
+			stage.Name = fmt.Sprintf("stage %d", i)
+		}
+		if stage.OnFail == "" {
+			stage.OnFail = stageActionBlock
+		}
+		if stage.OnFail != stageActionBlock && stage.OnFail != stageActionWarn {
+			return fmt.Errorf("stage '%s' has unrecognized on_fail action '%s'", stage.Name, stage.OnFail)
+		}
+		if stage.Penalty == nil {
+			stage.Penalty = intPointer(1)
+		}
+		if stage.FailMessage == "" {
+			stage.FailMessage = fmt.Sprintf("Didn't make it past %s", stage.Name)
+		}
+
+		switch stage.Kind {
+		case stageKindGate, stageKindOutputGate, stageKindGenerator:
+			if stage.Model == "" {
+				return fmt.Errorf("stage '%s' of kind '%s' needs a model", stage.Name, stage.Kind)
+			}
+			if stage.Template == "" {
+				stage.Template = stage.Model
+			}
+			if _, ok := builtinTemplates[stage.Template]; !ok && !strings.Contains(stage.Template, "{{modelname}}") {
+				return fmt.Errorf("stage '%s' template is neither a built-in template nor a Modelfile containing {{modelname}}", stage.Name)
+			}
+			if _, err := parseModelfile(stage.modelTemplate(defaultBaseModel)); err != nil {
+				return fmt.Errorf("stage '%s' template is not a valid Modelfile: %w", stage.Name, err)
+			}
+			if stage.Kind == stageKindGenerator {
+				hasGenerator = true
+				break
+			}
+			if stage.PassWhen == nil {
+				return fmt.Errorf("stage '%s' of kind '%s' needs pass_when", stage.Name, stage.Kind)
+			}
+			if stage.VerdictFormat == "" {
+				stage.VerdictFormat = defaultVerdictFormat
+			}
+			if stage.VerdictFormat != verdictFormatJSON && stage.VerdictFormat != verdictFormatLegacy {
+				return fmt.Errorf("stage '%s' has unrecognized verdict_format '%s' - expected one of '%s', '%s'", stage.Name, stage.VerdictFormat, verdictFormatJSON, verdictFormatLegacy)
+			}
+		case stageKindNormalize:
+			if stage.Input != "" && stage.Input != stageInputUser {
+				return fmt.Errorf("stage '%s' of kind '%s' can only normalize the user input", stage.Name, stage.Kind)
+			}
+		case stageKindDecode:
+			if stage.MaxDepth == nil {
+				stage.MaxDepth = intPointer(defaultMaxDecodeDepth)
+			}
+			if *stage.MaxDepth < 1 {
+				return fmt.Errorf("stage '%s' max_depth must be at least 1", stage.Name)
+			}
+			if stage.Input != "" && stage.Input != stageInputUser {
+				return fmt.Errorf("stage '%s' of kind '%s' can only decode the user input", stage.Name, stage.Kind)
+			}
+		case stageKindCheck:
+			switch stage.Check {
+			case checkSecretWord, checkSystemPrompt:
+			case checkRegex:
+				compiled, err := regexp.Compile(stage.Pattern)
+				if err != nil {
+					return fmt.Errorf("stage '%s' pattern is invalid: %w", stage.Name, err)
+				}
+				stage.compiledPattern = compiled
+			default:
+				return fmt.Errorf("stage '%s' has unrecognized check '%s'", stage.Name, stage.Check)
+			}
+		default:
+			return fmt.Errorf("stage '%s' has unrecognized kind '%s'", stage.Name, stage.Kind)
+		}
+
+		if stage.Input == "" {
+			stage.Input = stageInputUser
+			if stage.Kind == stageKindOutputGate {
+				stage.Input = stageInputGenie
+			}
+		}
+		switch stage.Input {
+		case stageInputUser, stageInputGenie, stageInputBoth, stageInputPrevious, stageInputConversation:
+		default:
+			return fmt.Errorf("stage '%s' has unrecognized input '%s'", stage.Name, stage.Input)
+		}
+		if (stage.Input == stageInputGenie || stage.Input == stageInputBoth) && !hasGenerator {
+			return fmt.Errorf("stage '%s' reads the genie output, but no generator stage runs before it", stage.Name)
+		}
+		if stage.Input == stageInputPrevious && i == 0 {
+			return fmt.Errorf("stage '%s' reads the previous stage output, but it is the first stage", stage.Name)
+		}
+	}
+	return nil
+}
+
+// the full ollama model name for a stage
+func (s *pipelineStage) modelName(baseModelName string) string {
+	return fmt.Sprintf("%s-%s", baseModelName, s.Model)
+}
+
+// the Modelfile content for a stage with the base model substituted in
+func (s *pipelineStage) modelTemplate(baseModelName string) string {
+	template, ok := getBuiltinTemplates()[s.Template]
+	if !ok {
+		template = s.Template
+	}
+	template = renderVerdictTemplate(template, s.VerdictFormat)
+	return strings.ReplaceAll(template, "{{modelname}}", baseModelName)
+}
+
+// pick the text a stage operates on
+func (s *pipelineStage) selectInput(userInput, genie, previous, conversation string) string {
+	switch s.Input {
+	case stageInputGenie:
+		return genie
+	case stageInputBoth:
+		return fmt.Sprintf("Customer: %s\nEmployee: %s", userInput, genie)
+	case stageInputPrevious:
+		return previous
+	case stageInputConversation:
+		return conversation
+	default:
+		return userInput
+	}
+}
+
+// true if the stage runs on a model of its own, rather than being a check or a decode stage
+func (s *pipelineStage) usesModel() bool {
+	return s.Kind == stageKindGate || s.Kind == stageKindOutputGate || s.Kind == stageKindGenerator
+}
+
+// true if the stage input includes the user input, so it should be checked in every decoded form
+func (s *pipelineStage) readsUserInput() bool {
+	return s.Input == stageInputUser || s.Input == stageInputBoth
+}
+
+// the secrets every generator stage has been told to keep
+func (p *pipelineDefinition) getProtectedValues(baseModelName string) ([]protectedValue, error) {
+	protectedValues := []protectedValue{}
+	for i := range p.Stages {
+		stage := &p.Stages[i]
+		if stage.Kind != stageKindGenerator {
+			continue
+		}
+		values, err := getProtectedValues(stage.Name, stage.modelTemplate(baseModelName))
+		if err != nil {
+			return nil, fmt.Errorf("stage '%s' template is not a valid Modelfile: %w", stage.Name, err)
+		}
+		protectedValues = append(protectedValues, values...)
+	}
+	return protectedValues, nil
+}
+
+// the SYSTEM and MESSAGE lines of every LLM stage
+func (p *pipelineDefinition) getPromptLines(baseModelName string) ([]promptLine, error) {
+	promptLines := []promptLine{}
+	for i := range p.Stages {
+		stage := &p.Stages[i]
+		if !stage.usesModel() {
+			continue
+		}
+		lines, err := getPromptLines(stage, stage.modelTemplate(baseModelName))
+		if err != nil {
+			return nil, fmt.Errorf("stage '%s' template is not a valid Modelfile: %w", stage.Name, err)
+		}
+		promptLines = append(promptLines, lines...)
+	}
+	return promptLines, nil
+}
+
+// create the guard for every stage that isn't a generator
+func (p *pipelineDefinition) buildGuards(backend llmBackend, baseModelName string, modelOptions map[string]interface{}) error {
+	protectedValues, err := p.getProtectedValues(baseModelName)
+	if err != nil {
+		return err
+	}
+	promptLines, err := p.getPromptLines(baseModelName)
+	if err != nil {
+		return err
+	}
+
+	for i := range p.Stages {
+		stage := &p.Stages[i]
+		switch stage.Kind {
+		case stageKindGate, stageKindOutputGate:
+			// JSON verdicts replace the SYSTEM prompt to describe the fields, so keep the original one around
+			definition, err := parseModelfile(stage.modelTemplate(baseModelName))
+			if err != nil {
+				return fmt.Errorf("stage '%s' template is not a valid Modelfile: %w", stage.Name, err)
+			}
+			stage.guard = newLlmGuard(backend, stage.modelName(baseModelName), modelOptions, *stage.PassWhen, stage.VerdictFormat, definition.System)
+		case stageKindCheck:
+			switch stage.Check {
+			case checkSecretWord:
+				stage.guard = newFuncGuard(func(ctx context.Context, input string) (bool, string, error) {
+					// a player's own flags replace the secrets in what their genie is told
+					secrets := append(getPlayerFlags(ctx), protectedValues...)
+					// the decoy genie is meant to say "the secret is ...", only the real secrets are still kept back
+					if isDecoyTurn(ctx) {
+						leaked, reason := detectLeak(input, secrets)
+						return !leaked, reason, nil
+					}
+					return checkLLMOutput(input, secrets)
+				})
+			case checkRegex:
+				stage.guard = newRegexGuard(stage.compiledPattern)
+			case checkSystemPrompt:
+				stage.guard = newFuncGuard(func(ctx context.Context, input string) (bool, string, error) {
+					return checkSystemPromptLeak(input, promptLines)
+				})
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// a secret compiled into the binary and written to a Modelfile can be solved once and shared with everyone, so
+// with -flag-key every player gets flags of their own: each genie's secret is swapped for an HMAC of the player
+// and the challenge under a server key, in the SYSTEM prompt sent along with every genie turn - the flag names
+// the player it was derived for, so a solve is attributed to whoever found it and a passed on flag gives itself away
+
+// Player flag settings
+const (
+	flagKeyBytes = 32
+	// how much of the HMAC goes into a flag, in bytes
+	flagMACBytes = 16
+)
+
+// read the server key from a file, creating the file with a random key if it doesn't exist yet
+func loadFlagKey(filePath string) ([]byte, error) {
+	data, err := os.ReadFile(filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		key := make([]byte, flagKeyBytes)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(filePath, []byte(hex.EncodeToString(key)+"\n"), 0600); err != nil {
+			return nil, err
+		}
+		fmt.Printf("info: created a new flag key in '%s'\n", filePath)
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) < flagKeyBytes {
+		return nil, fmt.Errorf("the flag key in '%s' must be at least %d hex encoded bytes", filePath, flagKeyBytes)
+	}
+	return key, nil
+}
+
+type flagDeriver struct {
+	key []byte
+}
+
+func newFlagDeriver(key []byte) *flagDeriver {
+	return &flagDeriver{key: key}
+}
+
+func (d *flagDeriver) mac(player string, challenge string) string {
+	mac := hmac.New(sha256.New, d.key)
+	mac.Write([]byte(challenge + "\x00" + player))
+	return hex.EncodeToString(mac.Sum(nil)[:flagMACBytes])
+}
+
+// the flag of a player for a challenge, the base64 of the challenge, the player and the HMAC of both
+func (d *flagDeriver) derive(player string, challenge string) string {
+	return base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s:%s", challenge, player, d.mac(player, challenge))))
+}
+
+// the player a genuine flag for the challenge was derived for, false if the flag isn't one
+func (d *flagDeriver) attribute(flag string, challenge string) (string, bool) {
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(flag))
+	if err != nil {
+		return "", false
+	}
+	fields := strings.SplitN(string(data), ":", 3)
+	if len(fields) != 3 || fields[0] != challenge {
+		return "", false
+	}
+	if !hmac.Equal([]byte(fields[2]), []byte(d.mac(fields[1], challenge))) {
+		return "", false
+	}
+	return fields[1], true
+}
+
+// the SYSTEM prompt of every genie of a level with its secret swapped for the player's flag, keyed by stage name
+func (d *flagDeriver) getGenieSystems(level *challengeLevel, player string, baseModelName string) (map[string]string, error) {
+	flag := d.derive(player, level.Challenge)
+	systems := map[string]string{}
+	for i := range level.pipeline.Stages {
+		stage := &level.pipeline.Stages[i]
+		if stage.Kind != stageKindGenerator {
+			continue
+		}
+		template := stage.modelTemplate(baseModelName)
+		definition, err := parseModelfile(template)
+		if err != nil {
+			return nil, fmt.Errorf("stage '%s' template is not a valid Modelfile: %w", stage.Name, err)
+		}
+		secrets, err := getProtectedValues(stage.Name, template)
+		if err != nil {
+			return nil, err
+		}
+		system := definition.System
+		for _, secret := range secrets {
+			system = strings.ReplaceAll(system, secret.Value, flag)
+		}
+		systems[stage.Name] = system
+	}
+	return systems, nil
+}
+
+// the player's flags travel with a turn so the output checks protect them like the secrets they replace
+type playerFlagsContextKey struct{}
+
+func withPlayerFlags(ctx context.Context, flags []protectedValue) context.Context {
+	return context.WithValue(ctx, playerFlagsContextKey{}, flags)
+}
+
+func getPlayerFlags(ctx context.Context) []protectedValue {
+	flags, _ := ctx.Value(playerFlagsContextKey{}).([]protectedValue)
+	return flags
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestFlagDeriver(t *testing.T, seed byte) *flagDeriver {
+	t.Helper()
+	return newFlagDeriver(bytes.Repeat([]byte{seed}, flagKeyBytes))
+}
+
+func TestFlagDerivation(t *testing.T) {
+	deriver := newTestFlagDeriver(t, 1)
+	flag := deriver.derive("alice", "shop")
+	if flag != deriver.derive("alice", "shop") {
+		t.Fatal("deriving the same flag twice gave two flags")
+	}
+	others := map[string]string{
+		"another player":    deriver.derive("bob", "shop"),
+		"another challenge": deriver.derive("alice", "level-2"),
+		"another key":       newTestFlagDeriver(t, 2).derive("alice", "shop"),
+	}
+	for name, other := range others {
+		if other == flag {
+			t.Errorf("%s gave the same flag", name)
+		}
+	}
+
+	if owner, ok := deriver.attribute(flag, "shop"); !ok || owner != "alice" {
+		t.Errorf("the flag was attributed to '%s' (%t), expected alice", owner, ok)
+	}
+	if owner, ok := deriver.attribute("  "+flag+"\n", "shop"); !ok || owner != "alice" {
+		t.Errorf("the flag with whitespace around it was attributed to '%s' (%t)", owner, ok)
+	}
+
+	data, err := base64.StdEncoding.DecodeString(flag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := strings.SplitN(string(data), ":", 3)
+	forgeries := map[string]string{
+		"another challenge": flag,
+		"another key":       newTestFlagDeriver(t, 2).derive("alice", "shop"),
+		"renamed player":    base64.StdEncoding.EncodeToString([]byte(fields[0] + ":bob:" + fields[2])),
+		"not base64":        "not a flag at all",
+		"no HMAC":           base64.StdEncoding.EncodeToString([]byte("shop:alice")),
+		"the genie secret":  genieSecret,
+	}
+	for name, forgery := range forgeries {
+		challenge := "shop"
+		if name == "another challenge" {
+			challenge = "level-2"
+		}
+		if owner, ok := deriver.attribute(forgery, challenge); ok {
+			t.Errorf("%s was attributed to '%s'", name, owner)
+		}
+	}
+}
+
+func TestSubmitSharedFlag(t *testing.T) {
+	app := newFakeShop(t, getFakeShopRules())
+	app.flags = newTestFlagDeriver(t, 1)
+	storePath := filepath.Join(t.TempDir(), "store.jsonl")
+	store, err := newStore(storePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.store = store
+
+	owner := newSession(app, "owner-session", "alice")
+	submitter := newSession(app, "submitter-session", "bob")
+	result, err := submitter.submitFlag(app, owner.playerFlag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Correct {
+		t.Fatal("another player's flag solved the level")
+	}
+
+	// the submitter hears the same thing as for any wrong flag
+	sink := newCollectingSink()
+	emitSubmitResult(sink, app, result)
+	wrong := newCollectingSink()
+	emitSubmitResult(wrong, app, submitResult{Level: result.Level, Attempts: result.Attempts})
+	if !sameMessages(sink.events, wrong.events) {
+		t.Errorf("a shared flag was answered with %+v, a wrong one with %+v", sink.events, wrong.events)
+	}
+	response, err := json.Marshal(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(response), "alice") {
+		t.Errorf("the submit response names the flag's owner: %s", response)
+	}
+
+	// the operator finds the owner in the store
+	data, err := os.ReadFile(storePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared := false
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		record := storeRecord{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatal(err)
+		}
+		shared = shared || (record.Kind == storeRecordSubmission && record.Player == "bob" && record.SharedBy == "alice")
+	}
+	if !shared {
+		t.Errorf("the store doesn't record whose flag was submitted:\n%s", data)
+	}
+
+	// and the owner's own flag still counts
+	if result, err := owner.submitFlag(app, owner.playerFlag); err != nil || !result.Correct {
+		t.Errorf("the owner's flag was rejected: %+v, %v", result, err)
+	}
+}
+
+// true if both sinks got the same messages, whenever they got them
+func sameMessages(a []turnEvent, b []turnEvent) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Key != b[i].Key || a[i].Message != b[i].Message {
+			return false
+		}
+	}
+	return true
+}
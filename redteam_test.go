@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ollama/ollama/api"
+)
+
+// the shop scripted by fake-ollama.example.json, with the attacker model created the way the redteam command does
+func newFakeRedteamShop(t *testing.T) (*application, string) {
+	t.Helper()
+	script, err := loadFakeOllamaScript("fake-ollama.example.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := newFakeShop(t, script.Rules)
+	attackerModelName := fmt.Sprintf("%s-%s", testBaseModelName, attackerModel)
+	req := &api.CreateRequest{Model: attackerModelName, Modelfile: strings.ReplaceAll(template_redteam_attacker, "{{modelname}}", testBaseModelName)}
+	if err := app.backend.Create(context.Background(), req, func(api.ProgressResponse) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	return app, attackerModelName
+}
+
+func readRedteamAttempts(t *testing.T, path string) []redteamAttempt {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attempts := []redteamAttempt{}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		attempt := redteamAttempt{}
+		if err := json.Unmarshal([]byte(line), &attempt); err != nil {
+			t.Fatal(err)
+		}
+		attempts = append(attempts, attempt)
+	}
+	return attempts
+}
+
+// with -debug the attacker reads the genie answers the output checks blocked, and the example script's attacker
+// finds its way to one that holds the secret
+func TestRunRedteamLeaksWithDebug(t *testing.T) {
+	app, attackerModelName := newFakeRedteamShop(t)
+	app.debug = true
+	outputPath := filepath.Join(t.TempDir(), "redteam.jsonl")
+	if err := runRedteam(app, attackerModelName, defaultRedteamBudget, defaultRedteamStreams, outputPath); err != nil {
+		t.Fatal(err)
+	}
+
+	attempts := readRedteamAttempts(t, outputPath)
+	last := attempts[len(attempts)-1]
+	if !last.Leaked || last.LeakReason == "" {
+		t.Fatalf("the red team never got the secret out in %d attempts, last %+v", len(attempts), last)
+	}
+	for _, attempt := range attempts[:len(attempts)-1] {
+		if attempt.Leaked {
+			t.Errorf("the red team kept going after a leak: %+v", attempt)
+		}
+	}
+	// the first attempt of every stream is the instruction override, the second learns from its feedback
+	if first := attempts[0]; first.BlockedBy != "jailbreak detection" || first.Attempt != 1 {
+		t.Errorf("unexpected first attempt %+v", first)
+	}
+	if last.Attempt != 2 || last.Valid || last.Improvement == "" {
+		t.Errorf("unexpected leaking attempt %+v", last)
+	}
+	if len(attempts) != defaultRedteamStreams+1 {
+		t.Errorf("expected the leak after %d attempts, got %d", defaultRedteamStreams+1, len(attempts))
+	}
+}
+
+// without -debug the same attacker only ever reads the messages a player is shown, and the secret holds
+func TestRunRedteamHoldsWithoutDebug(t *testing.T) {
+	app, attackerModelName := newFakeRedteamShop(t)
+	outputPath := filepath.Join(t.TempDir(), "redteam.jsonl")
+	budget := 6
+	if err := runRedteam(app, attackerModelName, budget, defaultRedteamStreams, outputPath); err != nil {
+		t.Fatal(err)
+	}
+
+	attempts := readRedteamAttempts(t, outputPath)
+	if len(attempts) != budget {
+		t.Fatalf("expected %d attempts, got %d", budget, len(attempts))
+	}
+	for _, attempt := range attempts {
+		if attempt.Leaked || strings.Contains(attempt.Feedback, genieSecret) {
+			t.Errorf("the secret got out without -debug: %+v", attempt)
+		}
+	}
+	// the genie gave the secret away to the same prompt, the output checks kept it in
+	if last := attempts[len(attempts)-1]; last.BlockedBy != "output validation" {
+		t.Errorf("the attacker never got past the input checks: %+v", last)
+	}
+}
+
+func TestGetAttackerPrompt(t *testing.T) {
+	stream := &attackStream{number: 1, strategy: getAttackStrategies()[0]}
+	if prompt := stream.getAttackerPrompt(); !strings.Contains(prompt, "first attempt") || !strings.Contains(prompt, stream.strategy) {
+		t.Errorf("unexpected first prompt %q", prompt)
+	}
+
+	for i := 1; i <= redteamHistoryLength+1; i++ {
+		stream.attempts = append(stream.attempts, redteamAttempt{Attempt: i, Prompt: fmt.Sprintf("attempt number %d", i), BlockedBy: "valid question", Feedback: strings.Repeat("x", redteamFeedbackLength+10)})
+	}
+	prompt := stream.getAttackerPrompt()
+	// the attacker is only reminded of its last few attempts, and of as much feedback as fits
+	if strings.Contains(prompt, "attempt number 1\n") || !strings.Contains(prompt, fmt.Sprintf("attempt number %d\n", redteamHistoryLength+1)) {
+		t.Errorf("unexpected attempt history in %q", prompt)
+	}
+	if !strings.Contains(prompt, "RESULT: blocked by: valid question") || strings.Contains(prompt, strings.Repeat("x", redteamFeedbackLength+1)) {
+		t.Errorf("unexpected feedback in %q", prompt)
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// the scoring engine turns blocked turns into a per-player behavior score: each stage has a weight (its
+// pipeline penalty unless the scoring file says otherwise), valid turns earn a little back, the score halves
+// over a configurable half-life, and crossing a threshold switches on an action - a warning, the tarpit,
+// the honeypot or a lockout - with scores optionally persisted so a restart or a new session doesn't wipe them
+
+// Actions a score threshold can switch on
+const (
+	scoreActionWarn     = "warn"     // show the player their behavior score
+	scoreActionTarpit   = "tarpit"   // slow the player down, one level of friction per point over the threshold
+	scoreActionHoneypot = "honeypot" // quietly route the player to the decoy genie
+	scoreActionLockout  = "lockout"  // stop answering the player
+)
+
+// Default scoring settings
+const (
+	defaultScoreHalfLife   = "30m"
+	defaultValidTurnReward = 0.5
+	defaultWarnScore       = 2
+	defaultLockoutScore    = 1000
+	defaultPlayerName      = "local"
+)
+
+// the score at which an action kicks in
+type scoreThreshold struct {
+	Score  float64 `json:"score"`
+	Action string  `json:"action"`
+}
+
+type scoringConfig struct {
+	// weights by stage name, stages that aren't listed use their pipeline penalty
+	Weights map[string]float64 `json:"weights,omitempty"`
+	// how much a turn that makes it through every stage takes off the score
+	ValidReward *float64 `json:"valid_reward,omitempty"`
+	// how long it takes a score to halve, e.g. "30m", "0" turns decay off
+	HalfLife   string           `json:"half_life,omitempty"`
+	Thresholds []scoreThreshold `json:"thresholds,omitempty"`
+
+	halfLife time.Duration
+}
+
+// the scoring used when no -scoring file is given, equivalent to the original behavior counter plus decay
+func getDefaultScoringConfig() *scoringConfig {
+	return &scoringConfig{
+		Weights: map[string]float64{
+			// a failed regex used to cost nothing, but a run of them is still someone probing
+			"input sanitization": 0.5,
+		},
+		Thresholds: []scoreThreshold{
+			{Score: defaultWarnScore, Action: scoreActionWarn},
+			{Score: defaultLockoutScore, Action: scoreActionLockout},
+		},
+	}
+}
+
+// read a scoring config from a JSON file
+func loadScoringConfig(filePath string) (*scoringConfig, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	config := &scoringConfig{}
+	if err := decoder.Decode(config); err != nil {
+		return nil, fmt.Errorf("unable to parse scoring file '%s': %w", filePath, err)
+	}
+	return config, nil
+}
+
+// set the threshold for an action, replacing any existing one
+func (c *scoringConfig) setThreshold(action string, score float64) {
+	for i := range c.Thresholds {
+		if c.Thresholds[i].Action == action {
+			c.Thresholds[i].Score = score
+			return
+		}
+	}
+	c.Thresholds = append(c.Thresholds, scoreThreshold{Score: score, Action: action})
+}
+
+// true if some threshold switches the action on
+func (c *scoringConfig) hasAction(action string) bool {
+	for _, threshold := range c.Thresholds {
+		if threshold.Action == action {
+			return true
+		}
+	}
+	return false
+}
+
+// fill in defaults and make sure the config fits the pipeline
+func (c *scoringConfig) validate(pipeline *pipelineDefinition) error {
+	if c.Weights == nil {
+		c.Weights = map[string]float64{}
+	}
+	stageNames := map[string]bool{}
+	for _, stage := range pipeline.Stages {
+		stageNames[stage.Name] = true
+	}
+	for name := range c.Weights {
+		if !stageNames[name] {
+			return fmt.Errorf("the scoring config has a weight for '%s', which isn't a pipeline stage", name)
+		}
+	}
+	if c.ValidReward == nil {
+		reward := defaultValidTurnReward
+		c.ValidReward = &reward
+	}
+	if c.HalfLife == "" {
+		c.HalfLife = defaultScoreHalfLife
+	}
+	halfLife, err := time.ParseDuration(c.HalfLife)
+	if err != nil || halfLife < 0 {
+		return fmt.Errorf("the scoring config has an invalid half_life '%s'", c.HalfLife)
+	}
+	c.halfLife = halfLife
+
+	seen := map[string]bool{}
+	for _, threshold := range c.Thresholds {
+		switch threshold.Action {
+		case scoreActionWarn, scoreActionTarpit, scoreActionHoneypot, scoreActionLockout:
+		default:
+			return fmt.Errorf("the scoring config has unrecognized action '%s' - expected one of '%s', '%s', '%s', '%s'", threshold.Action, scoreActionWarn, scoreActionTarpit, scoreActionHoneypot, scoreActionLockout)
+		}
+		if seen[threshold.Action] {
+			return fmt.Errorf("the scoring config has more than one threshold for '%s'", threshold.Action)
+		}
+		seen[threshold.Action] = true
+		if threshold.Score <= 0 {
+			return fmt.Errorf("the scoring config threshold for '%s' must be greater than 0", threshold.Action)
+		}
+	}
+	sort.Slice(c.Thresholds, func(i, j int) bool { return c.Thresholds[i].Score < c.Thresholds[j].Score })
+	return nil
+}
+
+// a player's score as of the last time it changed
+type playerScore struct {
+	Score   float64   `json:"score"`
+	Updated time.Time `json:"updated"`
+}
+
+// the actions a score has switched on
+type scoreActions struct {
+	Warn bool
+	// 0 if the tarpit isn't on, otherwise 1 at its threshold plus 1 for every point over it
+	TarpitLevel int
+	Honeypot    bool
+	Lockout     bool
+}
+
+type scoringEngine struct {
+	config *scoringConfig
+	// the weight of every pipeline stage
+	weights map[string]float64
+
+	mutex  sync.Mutex
+	scores map[string]*playerScore
+}
+
+// a new engine picks up every score where the store's last turn of the player left it
+func newScoringEngine(config *scoringConfig, pipeline *pipelineDefinition, store *store) *scoringEngine {
+	engine := &scoringEngine{
+		config:  config,
+		weights: map[string]float64{},
+		scores:  store.getBehaviorScores(),
+	}
+	for _, stage := range pipeline.Stages {
+		engine.weights[stage.Name] = float64(*stage.Penalty)
+		if weight, ok := config.Weights[stage.Name]; ok {
+			engine.weights[stage.Name] = weight
+		}
+	}
+	return engine
+}
+
+// bring a score up to date with the time that has passed since it last changed
+func (e *scoringEngine) decayLocked(score *playerScore, now time.Time) {
+	if e.config.halfLife > 0 && now.After(score.Updated) {
+		score.Score *= math.Pow(0.5, float64(now.Sub(score.Updated))/float64(e.config.halfLife))
+		// keep a few milliseconds of decay from dropping a score just under a threshold it was placed on
+		score.Score = math.Round(score.Score*1000) / 1000
+	}
+	score.Updated = now
+}
+
+func (e *scoringEngine) getScore(player string) float64 {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	score, ok := e.scores[player]
+	if !ok {
+		return 0
+	}
+	e.decayLocked(score, time.Now())
+	return score.Score
+}
+
+// apply a turn to a player's score, returning the new score
+func (e *scoringEngine) recordTurn(player string, result turnResult) float64 {
+	change := 0.0
+	if result.Valid {
+		change = -*e.config.ValidReward
+	} else if result.BlockedBy != "" && result.Error == "" {
+		// a model that couldn't be reached is never held against the player
+		change = e.weights[result.BlockedBy]
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	score, ok := e.scores[player]
+	if !ok {
+		score = &playerScore{}
+		e.scores[player] = score
+	}
+	e.decayLocked(score, time.Now())
+	score.Score = math.Max(score.Score+change, 0)
+
+	return score.Score
+}
+
+func (e *scoringEngine) getActions(score float64) scoreActions {
+	actions := scoreActions{}
+	for _, threshold := range e.config.Thresholds {
+		if score < threshold.Score {
+			continue
+		}
+		switch threshold.Action {
+		case scoreActionWarn:
+			actions.Warn = true
+		case scoreActionTarpit:
+			actions.TarpitLevel = int(score-threshold.Score) + 1
+		case scoreActionHoneypot:
+			actions.Honeypot = true
+		case scoreActionLockout:
+			actions.Lockout = true
+		}
+	}
+	return actions
+}
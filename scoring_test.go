@@ -0,0 +1,56 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// a scoring config for the default pipeline whose scores never decay, so a test can compare them exactly
+func newTestScoringConfig(t *testing.T, pipeline *pipelineDefinition) *scoringConfig {
+	t.Helper()
+	config := getDefaultScoringConfig()
+	config.HalfLife = "0"
+	if err := config.validate(pipeline); err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+func TestScoresRebuiltFromStore(t *testing.T) {
+	pipeline := getDefaultPipeline()
+	if err := pipeline.validate(); err != nil {
+		t.Fatal(err)
+	}
+	config := newTestScoringConfig(t, pipeline)
+	storePath := filepath.Join(t.TempDir(), "store.jsonl")
+	store, err := newStore(storePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine := newScoringEngine(config, pipeline, store)
+
+	turns := map[string][]turnResult{
+		"jailbreaker": {{BlockedBy: "jailbreak detection"}, {BlockedBy: "jailbreak detection"}},
+		"customer":    {{BlockedBy: "valid question"}, {Valid: true}},
+	}
+	for player, results := range turns {
+		for _, result := range results {
+			score := engine.recordTurn(player, result)
+			store.record(storeRecord{Kind: storeRecordTurn, Player: player, Result: &result, Behavior: score})
+		}
+	}
+
+	restartedStore, err := newStore(storePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restarted := newScoringEngine(config, pipeline, restartedStore)
+	for player := range turns {
+		if got, want := restarted.getScore(player), engine.getScore(player); got != want {
+			t.Errorf("'%s' has a score of %.1f after the restart, %.1f before it", player, got, want)
+		}
+	}
+	if score := restarted.getScore("jailbreaker"); score != 2 {
+		t.Errorf("two jailbreak attempts left a score of %.1f, expected 2", score)
+	}
+}
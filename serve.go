@@ -0,0 +1,269 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// the serve command hosts the guarded music shop as a web challenge, so a room full of players can share
+// one box instead of each getting a shell - every player gets their own behavior score and genie context
+
+//go:embed web/index.html
+var webIndexPage []byte
+
+// Limits for the HTTP API
+const (
+	maxMessageRequestBytes = 4096
+)
+
+type webServer struct {
+	app      *application
+	sessions *sessionManager
+}
+
+type sessionRequest struct {
+	// optional, the behavior score is kept under the player name across sessions
+	Player string `json:"player"`
+	// the token the player name was bound to when it was first used, required to use it again
+	PlayerToken string `json:"player_token"`
+}
+
+type submitRequest struct {
+	SessionID   string `json:"session_id"`
+	PlayerToken string `json:"player_token"`
+	Flag        string `json:"flag"`
+}
+
+type submitResponse struct {
+	SessionID string `json:"session_id"`
+	submitResult
+	Events []turnEvent `json:"events"`
+}
+
+type messageRequest struct {
+	SessionID   string `json:"session_id"`
+	PlayerToken string `json:"player_token"`
+	Message     string `json:"message"`
+}
+
+type messageResponse struct {
+	SessionID string `json:"session_id"`
+	turnResult
+	// false once the player has racked up too many errors to continue
+	Allowed  bool    `json:"allowed"`
+	Behavior float64 `json:"behavior"`
+	// the level the player is on after the message, 0 unless the shop runs with -levels
+	Level  int         `json:"level,omitempty"`
+	Events []turnEvent `json:"events"`
+}
+
+type historyResponse struct {
+	SessionID string           `json:"session_id"`
+	Player    string           `json:"player"`
+	CreatedAt time.Time        `json:"created_at"`
+	Behavior  float64          `json:"behavior"`
+	Attempts  []sessionAttempt `json:"attempts"`
+	Solves    []levelSolve     `json:"solves"`
+}
+
+type scoreboardResponse struct {
+	Players []scoreboardEntry `json:"players"`
+}
+
+type sessionResponse struct {
+	SessionID string `json:"session_id"`
+	Player    string `json:"player"`
+	// only when the player name was bound to a new token, which every later request has to carry
+	PlayerToken string      `json:"player_token,omitempty"`
+	Level       int         `json:"level,omitempty"`
+	Events      []turnEvent `json:"events"`
+}
+
+func newWebServer(app *application, sessions *sessionManager) *webServer {
+	return &webServer{
+		app:      app,
+		sessions: sessions,
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+func (s *webServer) handleIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(webIndexPage)
+}
+
+// start a new session and hand back the welcome message
+func (s *webServer) handleSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+	req := sessionRequest{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxMessageRequestBytes)).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("unable to parse request: %s", err))
+		return
+	}
+	if req.Player != "" {
+		if err := validatePlayerName(req.Player); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	session, token, err := s.sessions.startSession(req.Player, req.PlayerToken)
+	if errors.Is(err, errPlayerNameTaken) {
+		writeJSONError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+
+	sink := newPlayerSink(s.app.debug)
+	emitMessage(sink, "boss", "Welcome to the music shop! How can I assist you?")
+	resp := sessionResponse{SessionID: session.ID, Player: session.Player, PlayerToken: token}
+	if s.app.hasLevels() {
+		level := session.getLevel(s.app)
+		emitLevelIntro(sink, level, len(s.app.levels))
+		resp.Level = level.Number
+	}
+	resp.Events = sink.events
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// run a message through the pipeline and return the staged verdicts
+func (s *webServer) handleMessage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+	req := messageRequest{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxMessageRequestBytes)).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("unable to parse request: %s", err))
+		return
+	}
+
+	// an unknown or expired session is never swapped for a new player behind the client's back, it has to start one
+	session, ok := s.findPlayerSession(w, req.SessionID, req.PlayerToken)
+	if !ok {
+		return
+	}
+
+	if s.app.recorder != nil {
+		s.app.recorder.recordInput(req.Message)
+	}
+
+	sink := newPlayerSink(s.app.debug)
+	resp := messageResponse{SessionID: session.ID}
+	resp.turnResult, resp.Allowed = session.runTurn(s.app, req.Message, sink)
+	resp.Behavior = session.getBehavior(s.app)
+	if s.app.hasLevels() {
+		resp.Level = session.getLevel(s.app).Number
+	}
+	resp.Events = sink.events
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// check a flag the player found, the same as sending /submit as a message
+func (s *webServer) handleSubmit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+	req := submitRequest{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxMessageRequestBytes)).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("unable to parse request: %s", err))
+		return
+	}
+
+	session, ok := s.findPlayerSession(w, req.SessionID, req.PlayerToken)
+	if !ok {
+		return
+	}
+
+	// a locked out player can't submit flags any more than they can send messages
+	sink := newPlayerSink(s.app.debug)
+	if _, _, allowed := session.admitInput(s.app, req.Flag, sink); !allowed {
+		writeJSONError(w, http.StatusForbidden, "the behavior score has locked the player out")
+		return
+	}
+	result, err := session.submitFlag(s.app, req.Flag)
+	if err != nil {
+		writeJSONError(w, http.StatusConflict, err.Error())
+		return
+	}
+	emitSubmitResult(sink, s.app, result)
+	writeJSON(w, http.StatusOK, submitResponse{SessionID: session.ID, submitResult: result, Events: sink.events})
+}
+
+// find a live session for a request that carries the token of the session's player, writing the error if not
+func (s *webServer) findPlayerSession(w http.ResponseWriter, sessionID string, token string) (*Session, bool) {
+	session, ok := s.sessions.findSession(sessionID)
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "unknown or expired session")
+		return nil, false
+	}
+	if !session.checkPlayerToken(s.app, token) {
+		writeJSONError(w, http.StatusForbidden, "the player_token doesn't belong to the session's player")
+		return nil, false
+	}
+	return session, true
+}
+
+// every player ranked by level and time to solve
+func (s *webServer) handleScoreboard(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, scoreboardResponse{Players: s.app.store.getScoreboard(s.app.levels)})
+}
+
+// every attempt a player has made in their session
+func (s *webServer) handleHistory(w http.ResponseWriter, r *http.Request) {
+	session, ok := s.findPlayerSession(w, r.URL.Query().Get("session_id"), r.URL.Query().Get("player_token"))
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, historyResponse{
+		SessionID: session.ID,
+		Player:    session.Player,
+		CreatedAt: session.CreatedAt,
+		Behavior:  session.getBehavior(s.app),
+		Attempts:  session.getHistory(),
+		Solves:    session.getSolves(),
+	})
+}
+
+// serve the web challenge until the process is stopped
+func runServer(app *application, listenAddress string, sessions *sessionManager) {
+	sessions.startExpiry()
+	server := newWebServer(app, sessions)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", server.handleIndex)
+	mux.HandleFunc("/api/session", server.handleSession)
+	mux.HandleFunc("/api/message", server.handleMessage)
+	mux.HandleFunc("/api/submit", server.handleSubmit)
+	mux.HandleFunc("/api/history", server.handleHistory)
+	mux.HandleFunc("/api/scoreboard", server.handleScoreboard)
+
+	fmt.Printf("info: serving the music shop on '%s'\n", listenAddress)
+	log.Fatal(http.ListenAndServe(listenAddress, mux))
+}
@@ -0,0 +1,480 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// a Session owns everything that used to be a local of the prompt loop, so that one player's failed
+// jailbreaks never count against another's behavior score and each genie only remembers its own player
+
+// Default session limits
+const (
+	defaultMaxSessions = 100
+	defaultSessionTTL  = 30 * time.Minute
+)
+
+// how often idle sessions are looked for
+const (
+	sessionExpiryInterval = time.Minute
+)
+
+// player names are shown on the scoreboard and used as keys in the store
+var rxPlayerName = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,64}$`)
+
+func validatePlayerName(player string) error {
+	if !rxPlayerName.MatchString(player) {
+		return fmt.Errorf("player names are 1 to 64 letters, digits, dots, dashes or underscores")
+	}
+	return nil
+}
+
+// a random, unguessable session ID
+func newSessionID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// a random, unguessable token that proves a player name belongs to whoever it was issued to
+func newPlayerToken() (string, error) {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(token), nil
+}
+
+// the player name is bound to a token the request didn't carry
+var errPlayerNameTaken = errors.New("the player name is taken, send the player_token it was issued with to play as it")
+
+// a single input and what the pipeline made of it
+type sessionAttempt struct {
+	Time   time.Time  `json:"time"`
+	Input  string     `json:"input"`
+	Result turnResult `json:"result"`
+	// answered by the decoy genie, never shown to the player
+	Decoy bool `json:"-"`
+}
+
+// one player's state
+type Session struct {
+	ID string
+	// who is playing, the behavior score belongs to the player rather than the session
+	Player    string
+	CreatedAt time.Time
+	LastSeen  time.Time
+
+	// one turn at a time per player
+	turnMutex sync.Mutex
+	// guards the fields below and the timestamps, never held while a model is running
+	mutex sync.Mutex
+	// the genie conversation memory, only the generator stage uses it
+	memory  *conversationMemory
+	history []sessionAttempt
+	// set once the behavior score crosses the honeypot threshold, from then on the decoy genie
+	// answers with a memory of its own so the real genie never sees what the attacker tried
+	decoy       bool
+	decoyMemory *conversationMemory
+	// a message the tarpit asked the player to repeat
+	repromptInput string
+	// the level being played, counting from 1, without -levels the whole shop is level 1
+	level int
+	// set once the secret of the last level has been submitted
+	completed bool
+	// flags submitted for the current level so far
+	submissions int
+	solves      []levelSolve
+	// with -flag-key, the genie SYSTEM prompts carrying the player's flag for the current level, and the flag
+	genieSystems map[string]string
+	playerFlag   string
+	// a player without a name is bound to their token only here, until a solve gives the store something worth
+	// keeping for them - empty for named players and once the binding has been written to the store
+	anonymousTokenHash string
+}
+
+func newSession(app *application, id string, player string) *Session {
+	now := time.Now()
+	session := &Session{
+		ID:          id,
+		Player:      player,
+		CreatedAt:   now,
+		LastSeen:    now,
+		memory:      newConversationMemory(llmContextLength, app.memoryPolicy, app.memoryKeepBlocked),
+		history:     []sessionAttempt{},
+		decoyMemory: newConversationMemory(llmContextLength, app.memoryPolicy, app.memoryKeepBlocked),
+		level:       1,
+	}
+	// a returning player picks up where they left off
+	solved := app.store.getSolvedLevels(player, app.levels)
+	if solved == len(app.levels) {
+		session.level = solved
+		session.completed = true
+	} else {
+		session.level = solved + 1
+	}
+	session.prepareLevelLocked(app)
+	app.store.record(storeRecord{Kind: storeRecordSession, Player: player, SessionID: id, Level: session.level, Challenge: app.levels[session.level-1].Challenge})
+	return session
+}
+
+// give the genies of the current level the player's own flag
+func (s *Session) prepareLevelLocked(app *application) {
+	if app.flags == nil {
+		return
+	}
+	level := app.levels[s.level-1]
+	genieSystems, err := app.flags.getGenieSystems(level, s.Player, app.baseModelName)
+	if err != nil {
+		fmt.Printf("Error preparing the flags of player '%s': %s\n", s.Player, err)
+		return
+	}
+	s.genieSystems = genieSystems
+	s.playerFlag = app.flags.derive(s.Player, level.Challenge)
+}
+
+// everything a player sends, commands and flag submissions included, goes through the behavior score first
+// returns the score and its actions, and false once the player is locked out - anyone else waits out the tarpit
+func (s *Session) admitInput(app *application, userInput string, sink eventSink) (float64, scoreActions, bool) {
+	s.mutex.Lock()
+	s.LastSeen = time.Now()
+	s.mutex.Unlock()
+
+	behavior := app.scoring.getScore(s.Player)
+	actions := app.scoring.getActions(behavior)
+
+	// the decoy flag only comes from the decoy genie, so whoever sends it back has been caught
+	if app.honeypot != nil && app.honeypot.containsDecoyFlag(userInput) {
+		app.honeypot.log(honeypotLogEntry{SessionID: s.ID, Player: s.Player, Event: honeypotEventFlagSubmitted, Behavior: behavior, Input: userInput})
+	}
+
+	if actions.Lockout {
+		emitMessage(sink, "behavior score", fmt.Sprintf("Too many system errors (%.1f), please give us a ring a 867-5309 to help you further.", behavior))
+		return behavior, actions, false
+	}
+	if actions.Warn {
+		emitMessage(sink, "behavior score", fmt.Sprintf("%.1f", behavior))
+	}
+	getTarpitFriction(actions.TarpitLevel).wait(app.ctx)
+	return behavior, actions, true
+}
+
+// run one user input through the pipeline on behalf of this player
+// returns false as the second value once the player has racked up too many errors to continue
+func (s *Session) runTurn(app *application, userInput string, sink eventSink) (turnResult, bool) {
+	s.turnMutex.Lock()
+	defer s.turnMutex.Unlock()
+
+	behavior, actions, allowed := s.admitInput(app, userInput, sink)
+	if !allowed {
+		return turnResult{}, false
+	}
+	if handleChatCommand(app, s, userInput, sink) {
+		return turnResult{}, true
+	}
+
+	s.mutex.Lock()
+	attempt := sessionAttempt{Time: s.LastSeen, Input: userInput}
+	s.mutex.Unlock()
+
+	// once caught, a session stays with the decoy genie even as the score decays
+	if actions.Honeypot && app.honeypot != nil {
+		s.mutex.Lock()
+		routed := !s.decoy
+		s.decoy = true
+		s.mutex.Unlock()
+		if routed {
+			app.honeypot.log(honeypotLogEntry{SessionID: s.ID, Player: s.Player, Event: honeypotEventRouted, Behavior: behavior, Input: userInput})
+		}
+	}
+	s.mutex.Lock()
+	attempt.Decoy = s.decoy
+	s.mutex.Unlock()
+
+	options := turnOptions{decoy: attempt.Decoy}
+	options.pipeline = s.getLevel(app).pipeline
+	s.mutex.Lock()
+	if s.playerFlag != "" {
+		options.genieSystems = s.genieSystems
+		options.playerFlags = []protectedValue{newProtectedValue("player flag", s.playerFlag)}
+	}
+	s.mutex.Unlock()
+	if actions.TarpitLevel > 0 {
+		friction := getTarpitFriction(actions.TarpitLevel)
+		if friction.Reprompt && !s.checkReprompt(userInput) {
+			emitMessage(sink, "boss", tarpitRepromptMessage)
+			printUserEntry(sink)
+			return turnResult{}, true
+		}
+		options.maxGenieTokens = friction.MaxTokens
+	}
+
+	attempt.Result = runPipelineTurn(app, userInput, s.getMemory(), options, sink)
+	if attempt.Decoy {
+		app.honeypot.log(honeypotLogEntry{SessionID: s.ID, Player: s.Player, Event: honeypotEventTurn, Behavior: behavior, Input: userInput, Response: attempt.Result.Genie})
+	}
+	score := app.scoring.recordTurn(s.Player, attempt.Result)
+	level := s.getLevel(app)
+	app.store.record(storeRecord{
+		Kind:      storeRecordTurn,
+		Player:    s.Player,
+		SessionID: s.ID,
+		Level:     level.Number,
+		Challenge: level.Challenge,
+		Input:     userInput,
+		Result:    &attempt.Result,
+		Verdicts:  attempt.Result.Verdicts,
+		Behavior:  score,
+		Decoy:     attempt.Decoy,
+	})
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.history = append(s.history, attempt)
+	return attempt.Result, true
+}
+
+// true if the input repeats the one the tarpit asked the player to say again, otherwise it is asked for next time
+func (s *Session) checkReprompt(userInput string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.repromptInput != "" && s.repromptInput == userInput {
+		s.repromptInput = ""
+		return true
+	}
+	s.repromptInput = userInput
+	return false
+}
+
+// the memory of whichever genie is answering this player
+func (s *Session) getMemory() *conversationMemory {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.decoy {
+		return s.decoyMemory
+	}
+	return s.memory
+}
+
+// the level being played
+func (s *Session) getLevel(app *application) *challengeLevel {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return app.levels[s.level-1]
+}
+
+// check a submitted flag against the current level, moving on to the next level if it matches
+// the caller has put the submission through admitInput, which logs the decoy flag - it is never a solve
+func (s *Session) submitFlag(app *application, flag string) (submitResult, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	level := app.levels[s.level-1]
+	if s.completed {
+		return submitResult{}, fmt.Errorf("every level has already been completed")
+	}
+	if len(level.flagHashes) == 0 {
+		return submitResult{}, fmt.Errorf("the genie of level %d has no secret to find", level.Number)
+	}
+
+	flagHashes := level.flagHashes
+	if s.playerFlag != "" {
+		flagHashes = []flagHash{hashFlag(s.playerFlag)}
+	}
+
+	s.submissions++
+	result := submitResult{Level: level.Number, Attempts: s.submissions}
+	sharedBy := ""
+	defer func() {
+		app.store.record(storeRecord{Kind: storeRecordSubmission, Player: s.Player, SessionID: s.ID, Level: level.Number, Challenge: level.Challenge, Submission: &result, SharedBy: sharedBy})
+	}()
+	if !matchFlag(flag, flagHashes) {
+		// a genuine flag that was derived for somebody else has been passed on, only the operator is told whose
+		if app.flags != nil {
+			if owner, ok := app.flags.attribute(flag, level.Challenge); ok && owner != s.Player {
+				sharedBy = owner
+				fmt.Printf("warning: player '%s' submitted the level %d flag of player '%s'\n", s.Player, level.Number, owner)
+			}
+		}
+		return result, nil
+	}
+	result.Correct = true
+	result.Solve = &levelSolve{Level: level.Number, Time: time.Now(), Attempts: s.submissions}
+	// the solve is kept for good, so the name has to stay the player's after the session is gone
+	if s.anonymousTokenHash != "" {
+		if err := app.store.bindPlayer(s.Player, s.anonymousTokenHash); err != nil {
+			fmt.Printf("warning: unable to keep the name of anonymous player '%s': %s\n", s.Player, err)
+		} else {
+			s.anonymousTokenHash = ""
+		}
+	}
+	s.solves = append(s.solves, *result.Solve)
+	s.submissions = 0
+	if s.level == len(app.levels) {
+		s.completed = true
+		return result, nil
+	}
+	s.level++
+	s.prepareLevelLocked(app)
+	result.NextLevel = s.level
+	// the next level has a different genie, which has never met this player
+	s.memory.reset()
+	s.decoyMemory.reset()
+	return result, nil
+}
+
+// true if the token is the one the session's player was issued, compared in constant time
+func (s *Session) checkPlayerToken(app *application, token string) bool {
+	s.mutex.Lock()
+	tokenHash := s.anonymousTokenHash
+	s.mutex.Unlock()
+
+	if tokenHash == "" {
+		return app.store.checkPlayerToken(s.Player, token)
+	}
+	return token != "" && subtle.ConstantTimeCompare([]byte(hashPlayerToken(token)), []byte(tokenHash)) == 1
+}
+
+// a copy of every level completed so far
+func (s *Session) getSolves() []levelSolve {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return append([]levelSolve{}, s.solves...)
+}
+
+func (s *Session) lastSeen() time.Time {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.LastSeen
+}
+
+func (s *Session) getBehavior(app *application) float64 {
+	return app.scoring.getScore(s.Player)
+}
+
+// a copy of every attempt so far
+func (s *Session) getHistory() []sessionAttempt {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return append([]sessionAttempt{}, s.history...)
+}
+
+// sessions keyed by session ID, with idle expiry and a cap on how many can exist at once
+type sessionManager struct {
+	app         *application
+	maxSessions int
+	ttl         time.Duration
+
+	mutex    sync.Mutex
+	sessions map[string]*Session
+}
+
+func newSessionManager(app *application, maxSessions int, ttl time.Duration) *sessionManager {
+	return &sessionManager{
+		app:         app,
+		maxSessions: maxSessions,
+		ttl:         ttl,
+		sessions:    map[string]*Session{},
+	}
+}
+
+// start a new session for the named player, or for a player of their own if no name is given
+// the behavior score, level and flags all belong to the name, so a name that has been used before needs the token
+// it was bound to, and a name that hasn't is bound to a new token, returned along with the session
+func (m *sessionManager) startSession(player string, token string) (*Session, string, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := time.Now()
+	if len(m.sessions) >= m.maxSessions {
+		m.expireSessionsLocked(now)
+		if len(m.sessions) >= m.maxSessions {
+			return nil, "", fmt.Errorf("the shop is full (%d players), please try again later", m.maxSessions)
+		}
+	}
+
+	sessionID, err := newSessionID()
+	if err != nil {
+		return nil, "", err
+	}
+	// a player without a name is named after the session and bound in memory only, so visitors who never solve
+	// anything leave no claims behind in the store
+	issued := ""
+	anonymousTokenHash := ""
+	if player == "" {
+		player = sessionID
+		issued, err = newPlayerToken()
+		if err != nil {
+			return nil, "", err
+		}
+		anonymousTokenHash = hashPlayerToken(issued)
+	} else if !m.app.store.checkPlayerToken(player, token) {
+		// bound before the session starts, so a player never picks up progress that isn't theirs - the name of
+		// an anonymous player still playing isn't in the store yet, but it is just as taken
+		if _, ok := m.sessions[player]; ok {
+			return nil, "", errPlayerNameTaken
+		}
+		issued, err = m.app.store.claimPlayer(player)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	session := newSession(m.app, sessionID, player)
+	session.anonymousTokenHash = anonymousTokenHash
+	m.sessions[sessionID] = session
+	return session, issued, nil
+}
+
+// find an existing, unexpired session without starting a new one
+func (m *sessionManager) findSession(sessionID string) (*Session, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	session, ok := m.sessions[sessionID]
+	if !ok || time.Since(session.lastSeen()) > m.ttl {
+		return nil, false
+	}
+	return session, true
+}
+
+// drop every session that has been idle for longer than the TTL
+func (m *sessionManager) expireSessions() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.expireSessionsLocked(time.Now())
+}
+
+func (m *sessionManager) expireSessionsLocked(now time.Time) {
+	for sessionID, session := range m.sessions {
+		if now.Sub(session.lastSeen()) > m.ttl {
+			delete(m.sessions, sessionID)
+		}
+	}
+}
+
+// expire idle sessions in the background until the process exits
+func (m *sessionManager) startExpiry() {
+	go func() {
+		ticker := time.NewTicker(sessionExpiryInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			m.expireSessions()
+		}
+	}()
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// the store keeps what a lab afternoon produced - players, sessions, every turn with each stage's verdict, and
+// every flag submission and solve - as an append-only JSON lines file, so it needs nothing beyond the standard
+// library, survives a crash with at most a torn last line to cut off, and can be read back with any tool afterwards
+// on start the file is replayed to rebuild the scoreboard and each player's progress
+
+// Store record kinds
+const (
+	storeRecordSession    = "session"    // a session started
+	storeRecordTurn       = "turn"       // a turn ran through the pipeline
+	storeRecordSubmission = "submission" // a flag was submitted, a correct one is a solve
+	storeRecordPlayer     = "player"     // a player name was bound to a token
+)
+
+// a single line of the store
+type storeRecord struct {
+	Time      time.Time `json:"time"`
+	Kind      string    `json:"kind"`
+	Player    string    `json:"player"`
+	SessionID string    `json:"session_id"`
+	// the level the player was on and the challenge its flags are derived from
+	Level     int    `json:"level,omitempty"`
+	Challenge string `json:"challenge,omitempty"`
+	// turns only
+	Input    string         `json:"input,omitempty"`
+	Result   *turnResult    `json:"result,omitempty"`
+	Verdicts []stageVerdict `json:"verdicts,omitempty"`
+	Behavior float64        `json:"behavior,omitempty"`
+	Decoy    bool           `json:"decoy,omitempty"`
+	// submissions only, the flag itself is never kept
+	Submission *submitResult `json:"submission,omitempty"`
+	// with -flag-key, the player a submitted flag of someone else's was derived for
+	SharedBy string `json:"shared_by,omitempty"`
+	// players only, the SHA-256 of the token the name was bound to, the token itself is never kept
+	TokenHash string `json:"token_hash,omitempty"`
+}
+
+// everything the store knows about a player
+type playerStats struct {
+	FirstSeen   time.Time
+	Sessions    int
+	Turns       int
+	Blocked     int
+	Submissions int
+	// the solves by challenge
+	Solves map[string]levelSolve
+	// the hash of the token the name is bound to, empty until the name is first used in serve mode
+	TokenHash string
+	// the behavior score the last turn left the player with
+	Behavior playerScore
+}
+
+// a line of the scoreboard
+type scoreboardEntry struct {
+	Rank   int    `json:"rank"`
+	Player string `json:"player"`
+	// the highest level solved, 0 if none
+	Level int `json:"level"`
+	// from the player's first session to their last solve
+	TimeToSolve string     `json:"time_to_solve,omitempty"`
+	LastSolve   *time.Time `json:"last_solve,omitempty"`
+	Submissions int        `json:"submissions"`
+	Turns       int        `json:"turns"`
+
+	timeToSolve time.Duration
+}
+
+type store struct {
+	// empty to keep everything in memory only
+	filePath string
+
+	mutex   sync.Mutex
+	file    *os.File
+	players map[string]*playerStats
+}
+
+// open the store, replaying whatever an earlier run recorded
+func newStore(filePath string) (*store, error) {
+	s := &store{
+		filePath: filePath,
+		players:  map[string]*playerStats{},
+	}
+	if filePath == "" {
+		return s, nil
+	}
+
+	data, err := os.ReadFile(filePath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		// a crash mid-write leaves a torn last line, which is cut off so nothing gets appended to it
+		if complete := bytes.LastIndexByte(data, '\n') + 1; complete < len(data) {
+			fmt.Printf("warning: cutting off the torn last line of the store '%s'\n", filePath)
+			if err := os.Truncate(filePath, int64(complete)); err != nil {
+				return nil, err
+			}
+			data = data[:complete]
+		}
+		records := 0
+		for i, line := range bytes.Split(bytes.TrimSuffix(data, []byte("\n")), []byte("\n")) {
+			if len(line) == 0 {
+				continue
+			}
+			record := storeRecord{}
+			if err := json.Unmarshal(line, &record); err != nil {
+				return nil, fmt.Errorf("unable to parse line %d of store '%s': %w", i+1, filePath, err)
+			}
+			s.applyLocked(record)
+			records++
+		}
+		fmt.Printf("info: replayed %d records of %d players from the store '%s'\n", records, len(s.players), filePath)
+	}
+
+	s.file, err = os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// fold a record into the player statistics
+func (s *store) applyLocked(record storeRecord) {
+	stats, ok := s.players[record.Player]
+	if !ok {
+		stats = &playerStats{FirstSeen: record.Time, Solves: map[string]levelSolve{}}
+		s.players[record.Player] = stats
+	}
+	switch record.Kind {
+	case storeRecordSession:
+		stats.Sessions++
+	case storeRecordTurn:
+		stats.Turns++
+		stats.Behavior = playerScore{Score: record.Behavior, Updated: record.Time}
+		if record.Result != nil && record.Result.BlockedBy != "" && record.Result.Error == "" {
+			stats.Blocked++
+		}
+	case storeRecordPlayer:
+		// a name is only ever bound once
+		if stats.TokenHash == "" {
+			stats.TokenHash = record.TokenHash
+		}
+	case storeRecordSubmission:
+		stats.Submissions++
+		if record.Submission != nil && record.Submission.Solve != nil {
+			if _, solved := stats.Solves[record.Challenge]; !solved {
+				stats.Solves[record.Challenge] = *record.Submission.Solve
+			}
+		}
+	}
+}
+
+// add a record to the store and the statistics
+func (s *store) record(record storeRecord) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.recordLocked(record)
+}
+
+func (s *store) recordLocked(record storeRecord) {
+	record.Time = time.Now()
+	s.applyLocked(record)
+	if s.file == nil {
+		return
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		fmt.Printf("Error writing to the store: %s\n", err)
+		return
+	}
+	if _, err := s.file.Write(append(data, '\n')); err != nil {
+		fmt.Printf("Error writing to the store: %s\n", err)
+	}
+}
+
+// the behavior score of every player who has played a turn, as of that turn
+func (s *store) getBehaviorScores() map[string]*playerScore {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	scores := map[string]*playerScore{}
+	for player, stats := range s.players {
+		if stats.Turns > 0 {
+			score := stats.Behavior
+			scores[player] = &score
+		}
+	}
+	return scores
+}
+
+// bind a player name nobody has bound yet to a new random token, which every later request for the name has to carry
+func (s *store) claimPlayer(player string) (string, error) {
+	token, err := newPlayerToken()
+	if err != nil {
+		return "", err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.bindPlayerLocked(player, hashPlayerToken(token)); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// bind a player name nobody has bound yet to the hash of a token that was issued earlier
+func (s *store) bindPlayer(player string, tokenHash string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.bindPlayerLocked(player, tokenHash)
+}
+
+func (s *store) bindPlayerLocked(player string, tokenHash string) error {
+	if stats, ok := s.players[player]; ok && stats.TokenHash != "" {
+		return errPlayerNameTaken
+	}
+	s.recordLocked(storeRecord{Kind: storeRecordPlayer, Player: player, TokenHash: tokenHash})
+	return nil
+}
+
+// true if the token is the one the player name is bound to, compared in constant time
+func (s *store) checkPlayerToken(player string, token string) bool {
+	if token == "" {
+		return false
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	stats, ok := s.players[player]
+	if !ok || stats.TokenHash == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hashPlayerToken(token)), []byte(stats.TokenHash)) == 1
+}
+
+func hashPlayerToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// how many of the levels, in order, the player has already solved
+func (s *store) getSolvedLevels(player string, levels []*challengeLevel) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	stats, ok := s.players[player]
+	if !ok {
+		return 0
+	}
+	solved := 0
+	for _, level := range levels {
+		if _, ok := stats.Solves[level.Challenge]; !ok {
+			break
+		}
+		solved++
+	}
+	return solved
+}
+
+// every player who has played, ranked by the highest level solved and then by how quickly they got there
+func (s *store) getScoreboard(levels []*challengeLevel) []scoreboardEntry {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	entries := []scoreboardEntry{}
+	for player, stats := range s.players {
+		// a session that never sent anything isn't playing
+		if stats.Turns == 0 && stats.Submissions == 0 {
+			continue
+		}
+		entry := scoreboardEntry{Player: player, Submissions: stats.Submissions, Turns: stats.Turns}
+		for _, level := range levels {
+			solve, ok := stats.Solves[level.Challenge]
+			if !ok {
+				break
+			}
+			entry.Level = level.Number
+			entry.LastSolve = &solve.Time
+			entry.timeToSolve = solve.Time.Sub(stats.FirstSeen)
+			entry.TimeToSolve = entry.timeToSolve.Round(time.Second).String()
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Level != entries[j].Level {
+			return entries[i].Level > entries[j].Level
+		}
+		if entries[i].timeToSolve != entries[j].timeToSolve {
+			return entries[i].timeToSolve < entries[j].timeToSolve
+		}
+		return entries[i].Player < entries[j].Player
+	})
+	for i := range entries {
+		entries[i].Rank = i + 1
+	}
+	return entries
+}
+
+// describe a scoreboard line for the chat
+func (e scoreboardEntry) describe() string {
+	if e.Level == 0 {
+		return fmt.Sprintf("%d. %s - no levels yet (%d turns, %d flags submitted)", e.Rank, e.Player, e.Turns, e.Submissions)
+	}
+	return fmt.Sprintf("%d. %s - level %d in %s (%d turns, %d flags submitted)", e.Rank, e.Player, e.Level, e.TimeToSolve, e.Turns, e.Submissions)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// players submit the secrets they get out of the genie as flags, with /submit in the chat or POST /api/submit -
+// levels only keep the SHA-256 of their flags, a submission is hashed and compared in constant time, and every
+// solve is recorded with when it happened and how many flags it took
+
+// the hash a flag is stored and compared as
+type flagHash [sha256.Size]byte
+
+func hashFlag(flag string) flagHash {
+	return sha256.Sum256([]byte(flag))
+}
+
+// true if the submission matches any of the hashes, every hash is compared so the time taken gives nothing away
+func matchFlag(submission string, hashes []flagHash) bool {
+	submitted := hashFlag(strings.TrimSpace(submission))
+	matched := 0
+	for _, hash := range hashes {
+		matched |= subtle.ConstantTimeCompare(submitted[:], hash[:])
+	}
+	return matched == 1
+}
+
+// a level a player has completed
+type levelSolve struct {
+	Level int       `json:"level"`
+	Time  time.Time `json:"time"`
+	// how many flags the player submitted for the level, the correct one included
+	Attempts int `json:"attempts"`
+}
+
+// the outcome of a flag submission
+type submitResult struct {
+	Correct bool `json:"correct"`
+	// the level the flag was checked against
+	Level int `json:"level"`
+	// how many flags have been submitted for the level so far, this one included
+	Attempts int `json:"attempts"`
+	// set when the flag was correct
+	Solve *levelSolve `json:"solve,omitempty"`
+	// the level the player moves on to, 0 if there isn't one
+	NextLevel int `json:"next_level,omitempty"`
+}
+
+// tell the player how a submission went, another player's flag is just a wrong one so nobody learns whose it was
+func emitSubmitResult(sink eventSink, app *application, result submitResult) {
+	if !result.Correct {
+		emitMessage(sink, "error", fmt.Sprintf("That isn't the secret of level %d (attempt %d).", result.Level, result.Attempts))
+		return
+	}
+	emitMessage(sink, "level", fmt.Sprintf("Level %d complete on attempt %d!", result.Level, result.Attempts))
+	if result.NextLevel == 0 {
+		emitMessage(sink, "level", "That was the last level, the shop has no secrets left.")
+		return
+	}
+	emitLevelIntro(sink, app.levels[result.NextLevel-1], len(app.levels))
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// the tarpit adds friction for suspected attackers instead of a hard stop: once the scoring engine switches it
+// on, every point over its threshold slows the genie down, shortens its answers and eventually makes the player
+// say everything twice - the score decays and valid turns earn points back, so an automated jailbreak tool
+// grinding away feels it while a customer who slipped up once barely notices
+
+// Tarpit friction per level
+const (
+	tarpitDelayStep = 2 * time.Second
+	tarpitMaxDelay  = 30 * time.Second
+	// the genie's answer length in tokens at the first level, halved at every level after it
+	tarpitMaxTokens = 256
+	tarpitMinTokens = 16
+	// the level from which every message has to be sent twice before it is answered
+	tarpitRepromptLevel = 3
+)
+
+// what the boss says when the player has to repeat themselves
+const tarpitRepromptMessage = "Sorry, it's loud in here today, I didn't quite catch that. Could you say it again?"
+
+// the friction applied to a single turn
+type tarpitFriction struct {
+	// 0 means no friction at all
+	Level     int
+	Delay     time.Duration
+	MaxTokens int
+	Reprompt  bool
+}
+
+func getTarpitFriction(level int) tarpitFriction {
+	if level <= 0 {
+		return tarpitFriction{}
+	}
+
+	maxTokens := tarpitMaxTokens
+	for i := 1; i < level && maxTokens > tarpitMinTokens; i++ {
+		maxTokens /= 2
+	}
+	return tarpitFriction{
+		Level:     level,
+		Delay:     min(time.Duration(level)*tarpitDelayStep, tarpitMaxDelay),
+		MaxTokens: max(maxTokens, tarpitMinTokens),
+		Reprompt:  level >= tarpitRepromptLevel,
+	}
+}
+
+// sit in the tarpit, giving up early if the program is shutting down
+func (f tarpitFriction) wait(ctx context.Context) {
+	if f.Delay <= 0 {
+		return
+	}
+	timer := time.NewTimer(f.Delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+func TestGetTarpitFriction(t *testing.T) {
+	levels := []struct {
+		level    int
+		friction tarpitFriction
+	}{
+		{level: 0, friction: tarpitFriction{}},
+		{level: -1, friction: tarpitFriction{}},
+		{level: 1, friction: tarpitFriction{Level: 1, Delay: 2 * time.Second, MaxTokens: 256}},
+		{level: 2, friction: tarpitFriction{Level: 2, Delay: 4 * time.Second, MaxTokens: 128}},
+		{level: 3, friction: tarpitFriction{Level: 3, Delay: 6 * time.Second, MaxTokens: 64, Reprompt: true}},
+		{level: 5, friction: tarpitFriction{Level: 5, Delay: 10 * time.Second, MaxTokens: 16, Reprompt: true}},
+		// the delay and the answer length stop at their limits however far over the threshold the player is
+		{level: 40, friction: tarpitFriction{Level: 40, Delay: tarpitMaxDelay, MaxTokens: tarpitMinTokens, Reprompt: true}},
+	}
+	for _, l := range levels {
+		if friction := getTarpitFriction(l.level); friction != l.friction {
+			t.Errorf("level %d: expected %+v, got %+v", l.level, l.friction, friction)
+		}
+	}
+}
+
+func TestTarpitLevelFromScore(t *testing.T) {
+	pipeline := getDefaultPipeline()
+	if err := pipeline.validate(); err != nil {
+		t.Fatal(err)
+	}
+	config := newTestScoringConfig(t, pipeline)
+	config.Thresholds = []scoreThreshold{{Score: 4, Action: scoreActionTarpit}}
+	store, err := newStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine := newScoringEngine(config, pipeline, store)
+
+	scores := map[float64]int{0: 0, 3.9: 0, 4: 1, 4.9: 1, 5: 2, 7.5: 4}
+	for score, level := range scores {
+		if actions := engine.getActions(score); actions.TarpitLevel != level {
+			t.Errorf("a score of %.1f put the player in tarpit level %d, expected %d", score, actions.TarpitLevel, level)
+		}
+	}
+}
+
+// a shop shutting down doesn't wait for its slowest players
+func TestTarpitWaitCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Now()
+	getTarpitFriction(10).wait(ctx)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("a cancelled wait took %s", elapsed)
+	}
+}
+
+func TestTarpitReprompt(t *testing.T) {
+	app := newFakeShop(t, getFakeShopRules())
+	session := newSession(app, "session", "player")
+
+	if session.checkReprompt("Do you have jazz?") {
+		t.Error("a message was answered the first time it was sent")
+	}
+	if session.checkReprompt("Do you have blues?") {
+		t.Error("a different message counted as the repeat")
+	}
+	if !session.checkReprompt("Do you have blues?") {
+		t.Error("the repeated message still wasn't answered")
+	}
+	// once answered, the next message has to be repeated again
+	if session.checkReprompt("Do you have blues?") {
+		t.Error("a repeat was answered without being asked for again")
+	}
+}
+
+// a backend that keeps the options of every chat request on the way through
+type chatOptionsBackend struct {
+	llmBackend
+	options []map[string]interface{}
+}
+
+func (b *chatOptionsBackend) Chat(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+	b.options = append(b.options, req.Options)
+	return b.llmBackend.Chat(ctx, req, fn)
+}
+
+func TestTarpitShortensGenie(t *testing.T) {
+	app := newFakeShop(t, getFakeShopRules())
+	backend := &chatOptionsBackend{llmBackend: app.backend}
+	app.backend = backend
+
+	friction := getTarpitFriction(2)
+	runPipelineTurn(app, "Do you have any jazz records?", newTestMemory(app), turnOptions{maxGenieTokens: friction.MaxTokens}, newCollectingSink())
+	runPipelineTurn(app, "Do you have any jazz records?", newTestMemory(app), turnOptions{}, newCollectingSink())
+	if len(backend.options) != 2 {
+		t.Fatalf("expected two genie requests, got %d", len(backend.options))
+	}
+	if tokens := backend.options[0]["num_predict"]; tokens != friction.MaxTokens {
+		t.Errorf("the tarpit genie was asked for %v tokens, expected %d", tokens, friction.MaxTokens)
+	}
+	if _, ok := backend.options[1]["num_predict"]; ok {
+		t.Error("the genie's answer was capped outside the tarpit")
+	}
+	// the cap is on a copy, the shop's own options are left alone
+	if _, ok := app.modelOptions["num_predict"]; ok {
+		t.Error("the tarpit cap leaked into the shop's model options")
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/ollama/ollama/api"
+)
+
+// gatekeeper models are asked for a structured verdict in JSON mode instead of hoping the first few
+// characters of their answer are "true" or "false" - anything that doesn't parse strictly falls back
+// to llmToBool, so older or stubborn models still work
+// the ollama api this is built against (v0.1.32) only takes a format of "json", which makes the model answer
+// with some JSON object - constraining it to the verdict schema needs a newer ollama on both ends, so the
+// fields are described in the SYSTEM prompt instead and the parser does the enforcing
+
+// Verdict formats a gate stage can ask for
+const (
+	verdictFormatJSON   = "json"   // {"verdict": bool, "category": string, "confidence": number}
+	verdictFormatLegacy = "legacy" // a bare true or false, parsed by llmToBool
+)
+
+// Default verdict format for gate stages
+const (
+	defaultVerdictFormat = verdictFormatJSON
+)
+
+// the confidence given to every bare true or false, whether the gate asked for one or the JSON parser fell back
+const (
+	legacyVerdictConfidence = 0.5
+)
+
+// appended to the gate model's SYSTEM prompt in JSON mode, the built-in templates give their examples in this form
+const jsonVerdictInstruction = ` Respond only with a JSON object of the form {"verdict": true or false, "category": "a short label for the kind of text received", "confidence": a number from 0.0 to 1.0}.`
+
+// a structured gatekeeper verdict
+type gateVerdict struct {
+	Verdict    bool    `json:"verdict"`
+	Category   string  `json:"category"`
+	Confidence float64 `json:"confidence"`
+}
+
+// the wire format, with pointers so missing fields can be told apart from zero values
+type gateVerdictJSON struct {
+	Verdict    *bool    `json:"verdict"`
+	Category   *string  `json:"category"`
+	Confidence *float64 `json:"confidence"`
+}
+
+// parse a JSON verdict, rejecting unknown fields, missing fields, out of range confidences and trailing text
+func parseJSONVerdict(llmOutputText string) (gateVerdict, error) {
+	decoder := json.NewDecoder(strings.NewReader(strings.TrimSpace(llmOutputText)))
+	decoder.DisallowUnknownFields()
+
+	wire := gateVerdictJSON{}
+	if err := decoder.Decode(&wire); err != nil {
+		return gateVerdict{}, fmt.Errorf("unable to parse JSON verdict: %w", err)
+	}
+	if decoder.More() {
+		return gateVerdict{}, fmt.Errorf("unexpected text after the JSON verdict")
+	}
+	if wire.Verdict == nil {
+		return gateVerdict{}, fmt.Errorf("the JSON verdict has no 'verdict' field")
+	}
+	if wire.Category == nil {
+		return gateVerdict{}, fmt.Errorf("the JSON verdict has no 'category' field")
+	}
+	if wire.Confidence == nil {
+		return gateVerdict{}, fmt.Errorf("the JSON verdict has no 'confidence' field")
+	}
+	if *wire.Confidence < 0.0 || *wire.Confidence > 1.0 {
+		return gateVerdict{}, fmt.Errorf("the JSON verdict confidence %f is outside of 0.0 to 1.0", *wire.Confidence)
+	}
+	return gateVerdict{Verdict: *wire.Verdict, Category: strings.TrimSpace(*wire.Category), Confidence: *wire.Confidence}, nil
+}
+
+// parse a gatekeeper answer, strictly as JSON first and then the legacy way
+func parseVerdict(llmOutputText string) (gateVerdict, error) {
+	verdict, jsonErr := parseJSONVerdict(llmOutputText)
+	if jsonErr == nil {
+		return verdict, nil
+	}
+	legacyVerdict, err := llmToBool(llmOutputText)
+	if err != nil {
+		return gateVerdict{}, fmt.Errorf("%s, and %w", jsonErr, err)
+	}
+	return gateVerdict{Verdict: legacyVerdict, Confidence: legacyVerdictConfidence}, nil
+}
+
+// gate templates are written once for both verdict formats: {{verdict_instruction}} ends the SYSTEM prompt and
+// {{verdict:<true|false>:<category>}} is an example answer, both written out in the format of the stage
+var verdictExamplePattern = regexp.MustCompile(`\{\{verdict:(true|false):([^}]*)\}\}`)
+
+func renderVerdictTemplate(template string, verdictFormat string) string {
+	if verdictFormat == verdictFormatLegacy {
+		template = strings.ReplaceAll(template, "{{verdict_instruction}}", " Only state true or false.")
+		return verdictExamplePattern.ReplaceAllString(template, "$1")
+	}
+	template = strings.ReplaceAll(template, "{{verdict_instruction}}", "")
+	return verdictExamplePattern.ReplaceAllString(template, `{"verdict": $1, "category": "$2", "confidence": 0.95}`)
+}
+
+// ask a gatekeeper model for a verdict in JSON mode, with its SYSTEM prompt extended to describe the fields
+func getLlmJSONResponse(ctx context.Context, backend llmBackend, modelName string, modelOptions map[string]interface{}, system string, prompt string) (string, error) {
+	req := &api.GenerateRequest{
+		Model:   modelName,
+		Options: modelOptions,
+		Prompt:  prompt,
+		System:  system + jsonVerdictInstruction,
+		// the schema can't be passed with ollama v0.1.32, only that the answer is JSON
+		Format: "json",
+		Stream: new(bool),
+	}
+
+	var llmResponse bytes.Buffer
+	respFunc := func(resp api.GenerateResponse) error {
+		llmResponse.WriteString(resp.Response)
+		return nil
+	}
+
+	// ollama client generate function
+	err := backend.Generate(ctx, req, respFunc)
+	if err != nil {
+		return "", newBackendError(modelName, err)
+	}
+
+	return strings.TrimSpace(llmResponse.String()), nil
+}